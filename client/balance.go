@@ -0,0 +1,68 @@
+package client
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// balancer picks servers for the selection modes going by load, from the calls
+// of a single XClient, so every XClient balances its own calls whatever
+// Discovery offers the servers and however many XClients share it.
+type balancer struct {
+	mtx sync.Mutex // protect r
+	r   *rand.Rand
+	// pending returns the pending calls to a server, cost its latency times the calls in flight
+	pending func(rpcAddr string) int
+	cost    func(rpcAddr string) float64
+}
+
+func newBalancer(pending func(rpcAddr string) int, cost func(rpcAddr string) float64) *balancer {
+	return &balancer{r: rand.New(rand.NewSource(time.Now().UnixNano())), pending: pending, cost: cost}
+}
+
+// byLoad tells whether mode selects servers by load.
+func byLoad(mode int) bool {
+	return mode == LeastPendingSelect || mode == PowerOfTwoChoicesSelect || mode == PeakEWMASelect
+}
+
+// get picks one of servers according to mode, which must go by load.
+func (b *balancer) get(mode int, servers []string) string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	pending := func(s string) float64 { return float64(b.pending(s)) }
+	switch mode {
+	case PeakEWMASelect:
+		return b.least(servers, b.cost)
+	case PowerOfTwoChoicesSelect:
+		n := len(servers)
+		if n == 1 {
+			return servers[0]
+		}
+		i, j := b.r.Intn(n), b.r.Intn(n-1)
+		if j >= i {
+			j++
+		}
+		return b.least([]string{servers[i], servers[j]}, pending)
+	default:
+		return b.least(servers, pending)
+	}
+}
+
+// least picks the server of servers with the least value of f,
+// one of them randomly if several have as little.
+func (b *balancer) least(servers []string, f func(string) float64) string {
+	best, least, ties := "", 0.0, 0
+	for _, s := range servers {
+		v := f(s)
+		switch {
+		case best == "" || v < least:
+			best, least, ties = s, v, 1
+		case v == least:
+			if ties++; b.r.Intn(ties) == 0 {
+				best = s
+			}
+		}
+	}
+	return best
+}
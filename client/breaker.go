@@ -0,0 +1,175 @@
+package client
+
+import (
+	"ToyRPC/status"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of the circuit breaker of a server.
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // calls go through
+	BreakerOpen                         // calls fail right away, the server is skipped
+	BreakerHalfOpen                     // a probe call tells whether to close again
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerOption configures the circuit breakers XClient keeps per server.
+// A call fails in the eyes of a breaker when the server is unavailable,
+// the call times out or takes longer than SlowCall. Errors returned by
+// the method don't count, neither do calls the caller cancelled.
+type BreakerOption struct {
+	Window        time.Duration // calls are counted over that long, 0 means 10s
+	MinCalls      int           // calls in the window before the breaker may open, 0 means 10
+	FailureRate   float64       // open once that fraction of the calls failed, 0 means 0.5
+	SlowCall      time.Duration // calls taking longer fail, 0 means no limit
+	ProbeInterval time.Duration // how long to stay open before a probe call, 0 means 5s
+	// OnStateChange is called when the breaker of rpcAddr changes its state, if not nil
+	OnStateChange func(rpcAddr string, from, to BreakerState)
+}
+
+// breaker is the circuit breaker of a server.
+type breaker struct {
+	state    BreakerState
+	start    time.Time // of the window
+	calls    int       // in the window
+	failures int       // in the window
+	opened   time.Time // when the breaker opened last
+	probing  bool      // a probe call is in flight
+}
+
+// breakers keeps a breaker per server.
+type breakers struct {
+	opt      BreakerOption
+	mtx      sync.Mutex // protect following
+	breakers map[string]*breaker
+}
+
+func newBreakers(opt BreakerOption) *breakers {
+	if opt.Window <= 0 {
+		opt.Window = 10 * time.Second
+	}
+	if opt.MinCalls <= 0 {
+		opt.MinCalls = 10
+	}
+	if opt.FailureRate <= 0 {
+		opt.FailureRate = 0.5
+	}
+	if opt.ProbeInterval <= 0 {
+		opt.ProbeInterval = 5 * time.Second
+	}
+	return &breakers{opt: opt, breakers: make(map[string]*breaker)}
+}
+
+// get returns the breaker of rpcAddr, bs.mtx must be held.
+func (bs *breakers) get(rpcAddr string) *breaker {
+	b, ok := bs.breakers[rpcAddr]
+	if !ok {
+		b = &breaker{start: time.Now()}
+		bs.breakers[rpcAddr] = b
+	}
+	return b
+}
+
+// set changes the state of b, it returns the callback to call once bs.mtx is released.
+func (bs *breakers) set(rpcAddr string, b *breaker, to BreakerState) func() {
+	from := b.state
+	b.state = to
+	b.start, b.calls, b.failures = time.Now(), 0, 0
+	if to == BreakerOpen {
+		b.opened = time.Now()
+	}
+	if bs.opt.OnStateChange == nil || from == to {
+		return func() {}
+	}
+	return func() { bs.opt.OnStateChange(rpcAddr, from, to) }
+}
+
+// ready reports whether a call to rpcAddr would be let through.
+func (bs *breakers) ready(rpcAddr string) bool {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	b := bs.get(rpcAddr)
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.opened) >= bs.opt.ProbeInterval
+	case BreakerHalfOpen:
+		return !b.probing
+	}
+	return true
+}
+
+// allow lets a call to rpcAddr through, unless the breaker is open.
+// Once the probe interval has passed, a single call goes through as a probe.
+func (bs *breakers) allow(rpcAddr string) error {
+	bs.mtx.Lock()
+	b := bs.get(rpcAddr)
+	notify := func() {}
+	if b.state == BreakerOpen && time.Since(b.opened) >= bs.opt.ProbeInterval {
+		notify = bs.set(rpcAddr, b, BreakerHalfOpen)
+	}
+	var err error
+	switch {
+	case b.state == BreakerOpen, b.state == BreakerHalfOpen && b.probing:
+		err = status.New(status.Unavailable, "rpc xclient: circuit breaker of "+rpcAddr+" is open")
+	case b.state == BreakerHalfOpen:
+		b.probing = true
+	}
+	bs.mtx.Unlock()
+	notify()
+	return err
+}
+
+// record counts a call to rpcAddr allow let through.
+func (bs *breakers) record(rpcAddr string, err error, latency time.Duration) {
+	code := status.CodeOf(err)
+	failed := retryable(err) || code == status.DeadlineExceeded ||
+		bs.opt.SlowCall > 0 && latency > bs.opt.SlowCall
+	bs.mtx.Lock()
+	b := bs.get(rpcAddr)
+	notify := func() {}
+	switch {
+	case b.state == BreakerHalfOpen:
+		b.probing = false
+		if code == status.Canceled {
+			break // tells nothing, probe again
+		}
+		if failed {
+			notify = bs.set(rpcAddr, b, BreakerOpen)
+		} else {
+			notify = bs.set(rpcAddr, b, BreakerClosed)
+		}
+	case b.state == BreakerClosed && code != status.Canceled:
+		if time.Since(b.start) > bs.opt.Window {
+			b.start, b.calls, b.failures = time.Now(), 0, 0
+		}
+		b.calls++
+		if failed {
+			b.failures++
+		}
+		if b.calls >= bs.opt.MinCalls && float64(b.failures) >= bs.opt.FailureRate*float64(b.calls) {
+			notify = bs.set(rpcAddr, b, BreakerOpen)
+		}
+	}
+	bs.mtx.Unlock()
+	notify()
+}
+
+func (bs *breakers) state(rpcAddr string) BreakerState {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	return bs.get(rpcAddr).state
+}
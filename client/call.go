@@ -1,5 +1,10 @@
 package client
 
+import (
+	"ToyRPC/metadata"
+	"time"
+)
+
 type Call struct {
 	Seq           uint64
 	ServiceMethod string
@@ -7,8 +12,16 @@ type Call struct {
 	Reply         interface{}
 	Err           error
 	Done          chan *Call
+	Metadata      metadata.MD   // sent with the request
+	Trailer       metadata.MD   // received with the response
+	Timeout       time.Duration // how long the server may work on the call, 0 means no limit
+	stream        *ClientStream // receives the replies of a streaming method
+	written       bool          // the request was handed to the connection, it may have reached the server
 }
 
 func (call *Call) done() {
+	if call.stream != nil {
+		call.stream.finish(call.Err, false)
+	}
 	call.Done <- call
 }
@@ -2,7 +2,9 @@ package client
 
 import (
 	"ToyRPC/codec"
+	"ToyRPC/metadata"
 	server "ToyRPC/service"
+	"ToyRPC/status"
 	"bufio"
 	"context"
 	"encoding/json"
@@ -28,13 +30,14 @@ const (
 type Client struct {
 	cc       codec.Codec      // for encode and decode request and response
 	opt      *server.Option   // for codec header
-	send_mtx sync.Mutex       // protect following
-	header   codec.Header     // for request
+	send_mtx sync.Locker      // serialize messages, see codec.SendLocker
 	mtx      sync.Mutex       // protect following
 	seq      uint64           // sequence number for requests
 	pending  map[uint64]*Call // store calls that are waiting for server response
 	closing  bool             // user has called Close
 	shutdown bool             // server has told us to stop
+	// interceptors wrap every Call, see Use
+	interceptors []Interceptor
 }
 
 type clientResult struct {
@@ -54,6 +57,13 @@ func (client *Client) Close() error {
 
 var _ io.Closer = (*Client)(nil)
 
+// NumPending returns how many calls and streams wait for the server.
+func (client *Client) NumPending() int {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	return len(client.pending)
+}
+
 func (client *Client) IsAvailable() bool {
 	client.mtx.Lock()
 	defer client.mtx.Unlock()
@@ -65,7 +75,7 @@ func (client *Client) register(call *Call) (uint64, error) {
 	client.mtx.Lock()
 	defer client.mtx.Unlock()
 	if client.closing || client.shutdown {
-		return 0, errors.New("rpc client is closing")
+		return 0, status.New(status.Unavailable, "rpc client is closing")
 	}
 	call.Seq = client.seq
 	client.pending[call.Seq] = call
@@ -82,14 +92,40 @@ func (client *Client) remove(seq uint64) *Call {
 	return call
 }
 
+// goAway stops new calls, the server still answers the pending ones
+func (client *Client) goAway() {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	client.shutdown = true
+	client.closeIfDrainedLocked()
+}
+
+// closeIfDrained closes the connection once the server told us to go away
+// and every pending call is answered.
+func (client *Client) closeIfDrained() {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	client.closeIfDrainedLocked()
+}
+
+func (client *Client) closeIfDrainedLocked() {
+	if client.shutdown && !client.closing && len(client.pending) == 0 {
+		client.closing = true
+		_ = client.cc.Close()
+	}
+}
+
 // terminate terminates all pending calls
 func (client *Client) terminate(err error) {
 	client.mtx.Lock()
 	defer client.mtx.Unlock()
+	client.shutdown = true
 	for _, call := range client.pending {
-		call.Err = err
+		call.Err = status.New(status.Unavailable, err.Error())
 		call.done()
 	}
+	client.pending = make(map[uint64]*Call)
+	client.closeIfDrainedLocked()
 }
 
 func (client *Client) send(call *Call) {
@@ -101,10 +137,14 @@ func (client *Client) send(call *Call) {
 		call.done()
 		return
 	}
-	client.header.ServiceMethod = call.ServiceMethod
-	client.header.Seq = seq
-	client.header.Error = ""
-	if err := client.cc.Write(&client.header, call.Args); err != nil {
+	h := &codec.Header{
+		ServiceMethod: call.ServiceMethod,
+		Seq:           seq,
+		Metadata:      call.Metadata,
+		Timeout:       call.Timeout,
+	}
+	call.written = true // even a failed write may have sent the request
+	if err := client.cc.Write(h, call.Args); err != nil {
 		call := client.remove(seq)
 		if call != nil {
 			call.Err = err
@@ -113,17 +153,40 @@ func (client *Client) send(call *Call) {
 	}
 }
 
-func (client *Client) Go(serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
-	if done == nil {
-		done = make(chan *Call, 10)
-	} else if cap(done) == 0 {
-		log.Panic("rpc client: done channel is unbuffered")
+// sendCancel sends a cancel message for seq, errors are ignored
+// since the call has already failed on the client side.
+func (client *Client) sendCancel(seq uint64) {
+	_ = client.write(&codec.Header{Seq: seq, Kind: codec.KindCancel}, struct{}{})
+}
+
+// write sends a message other than a request, such as a stream message.
+func (client *Client) write(h *codec.Header, body interface{}) error {
+	client.send_mtx.Lock()
+	defer client.send_mtx.Unlock()
+	client.mtx.Lock()
+	closing := client.closing
+	client.mtx.Unlock()
+	if closing {
+		return status.New(status.Unavailable, "rpc client is closing")
 	}
-	call := &Call{
+	return client.cc.Write(h, body)
+}
+
+func (client *Client) Go(serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
+	return client.goCall(&Call{
 		ServiceMethod: serviceMethod,
 		Args:          args,
 		Reply:         reply,
 		Done:          done,
+	})
+}
+
+// goCall sends call asynchronously, the call is sent to call.Done when it's complete.
+func (client *Client) goCall(call *Call) *Call {
+	if call.Done == nil {
+		call.Done = make(chan *Call, 10)
+	} else if cap(call.Done) == 0 {
+		log.Panic("rpc client: done channel is unbuffered")
 	}
 	client.send(call)
 	return call
@@ -137,34 +200,96 @@ func (client *Client) receive() {
 		if err = client.cc.ReadHeader(&header); err != nil {
 			break
 		}
+		if header.Kind == codec.KindGoAway {
+			if err = client.cc.ReadBody(nil); err == nil {
+				client.goAway()
+			}
+			continue
+		}
+		if header.Kind == codec.KindStream || header.Kind == codec.KindWindow {
+			err = client.receiveStream(&header)
+			continue
+		}
 		call := client.remove(header.Seq)
+		if call != nil {
+			call.Trailer = header.Metadata
+		}
 		switch {
 		case call == nil:
 			// it usually means that Write partially failed
 			// and call was already removed.
 			err = client.cc.ReadBody(nil)
 		case header.Error != "":
-			call.Err = fmt.Errorf(header.Error)
+			call.Err = serverError(&header)
+			err = client.cc.ReadBody(nil)
+			call.done()
+		case call.stream != nil:
+			// the end of the stream, or the reply of a method which isn't streaming
+			if header.Kind == codec.KindStreamEnd {
+				err = client.cc.ReadBody(nil)
+			} else if err = call.stream.push(client.cc); err != nil {
+				call.Err = status.New(status.Internal, "reading body "+err.Error())
+			}
+			call.done()
+		case header.Kind == codec.KindStreamEnd:
 			err = client.cc.ReadBody(nil)
+			call.Err = status.New(status.FailedPrecondition, "rpc client: "+call.ServiceMethod+" is a streaming method, use Client.Stream")
 			call.done()
 		default:
 			// normal case
 			if err = client.cc.ReadBody(call.Reply); err != nil {
-				call.Err = errors.New("reading body " + err.Error())
+				call.Err = status.New(status.Internal, "reading body "+err.Error())
 			}
 			call.done()
 		}
+		if err == nil {
+			client.closeIfDrained()
+		}
 	}
 	// error occurs, so terminateCalls pending calls
 	client.terminate(err)
 }
 
+// remotePanic is the error of a call whose method panicked on the server,
+// errors.Is(err, server.ErrPanic) reports it.
+// It wraps the Internal *status.Error the server sent.
+type remotePanic struct {
+	st *status.Error
+}
+
+func (e remotePanic) Error() string {
+	return e.st.Error()
+}
+
+func (e remotePanic) Is(target error) bool {
+	return target == server.ErrPanic
+}
+
+func (e remotePanic) Unwrap() error {
+	return e.st
+}
+
+// serverError returns the error the server sent in h,
+// it is a *status.Error, Unknown if the server sent no code.
+func serverError(h *codec.Header) error {
+	code := status.Code(h.Code)
+	if code == status.OK {
+		code = status.Unknown
+	}
+	st := &status.Error{Code: code, Message: h.Error, Details: h.Details}
+	if code == status.Internal && strings.HasPrefix(h.Error, server.ErrPanic.Error()) {
+		return remotePanic{st}
+	}
+	return st
+}
+
 func newClientCodec(cc codec.Codec, opt *server.Option) *Client {
 	client := &Client{
-		seq:     1, // seq starts with 1, 0 means invalid call
-		cc:      cc,
-		opt:     opt,
-		pending: make(map[uint64]*Call),
+		seq:      1, // seq starts with 1, 0 means invalid call
+		cc:       cc,
+		opt:      opt,
+		send_mtx: codec.SendLocker(cc),
+		pending:  make(map[uint64]*Call),
 	}
 	go client.receive()
 	return client
@@ -177,6 +302,14 @@ func newClient(connect net.Conn, opt *server.Option) (*Client, error) {
 		log.Println("rpc client: codec error:", err)
 		return nil, err
 	}
+	f, err := codec.NewCompressCodecFunc(f, opt.Compress, opt.CompressThreshold)
+	if err != nil {
+		log.Println("rpc client: compression error:", err)
+		return nil, err
+	}
+	if opt.Multiplex {
+		f = codec.NewMuxCodecFunc(f, opt.ChunkSize)
+	}
 	if err := json.NewEncoder(connect).Encode(opt); err != nil {
 		log.Println("rpc client: options error: ", err)
 		_ = connect.Close()
@@ -240,13 +373,67 @@ func (client *Client) CallWithoutTimeout(serviceMethod string, args interface{},
 	return call.Err
 }
 
+// Call invokes the named function and waits for it to complete.
+// The outgoing metadata and the remaining time of ctx are sent with the request,
+// trailers are stored where metadata.WithTrailer asked for.
+// The interceptors added by Use run around it.
 func (client *Client) Call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	client.mtx.Lock()
+	interceptors := client.interceptors
+	client.mtx.Unlock()
+	if len(interceptors) == 0 {
+		return client.call(ctx, serviceMethod, args, reply)
+	}
+	return chainInterceptors(interceptors, client.call)(ctx, serviceMethod, args, reply)
+}
+
+// Use adds interceptors wrapping every Call, in the order given.
+func (client *Client) Use(interceptors ...Interceptor) {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	client.interceptors = append(client.interceptors, interceptors...)
+}
+
+type writtenKey struct{}
+
+// withWritten asks Client.Call to store in *written whether the request
+// was written, a call refused by the client itself is known not to reach the server.
+func withWritten(ctx context.Context, written *bool) context.Context {
+	return context.WithValue(ctx, writtenKey{}, written)
+}
+
+func (client *Client) call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          make(chan *Call, 1),
+		Metadata:      md,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		// the server gives up at the same time as we do
+		if call.Timeout = time.Until(deadline); call.Timeout <= 0 {
+			return status.New(status.DeadlineExceeded, "rpc client: call failed: "+context.DeadlineExceeded.Error())
+		}
+	}
+	client.goCall(call)
+	if written, ok := ctx.Value(writtenKey{}).(*bool); ok {
+		*written = call.written
+	}
 	select {
 	case <-ctx.Done(): // if the context is canceled, the call will be removed from the pending map
-		client.remove(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		if client.remove(call.Seq) != nil {
+			// still waiting for the response, tell the server to stop working on it
+			client.sendCancel(call.Seq)
+			client.closeIfDrained()
+		}
+		st, _ := status.FromError(ctx.Err())
+		return status.New(st.Code, "rpc client: call failed: "+ctx.Err().Error())
 	case call := <-call.Done: // if the call is done, the result will be returned
+		if trailer := metadata.ReceivedTrailer(ctx); trailer != nil {
+			*trailer = call.Trailer
+		}
 		return call.Err
 	}
 }
@@ -302,7 +489,9 @@ func DialHTTP(network, address string, opts ...*server.Option) (*Client, error)
 // according the first parameter rpcAddr.
 // rpcAddr is a general format (protocol@addr) to represent a rpc server
 // eg, http@10.0.0.1:7001, tcp@10.0.0.1:9999, unix@/tmp/toyrpc.sock
+// The metadata of the server may follow as a query, eg, tcp@10.0.0.1:9999?weight=2
 func XDial(rpcAddr string, opts ...*server.Option) (*Client, error) {
+	rpcAddr, _ = splitAddr(rpcAddr)
 	parts := strings.Split(rpcAddr, "@")
 	if len(parts) != 2 {
 		return nil, fmt.Errorf("rpc client err: wrong format '%s', expect protocol@addr", rpcAddr)
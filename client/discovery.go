@@ -10,16 +10,24 @@
 package client
 
 import (
-	"errors"
+	"ToyRPC/status"
 	"math"
 	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	RandomSelect     int = iota // select randomly
-	RoundRobinSelect            // select using Robbin algorithm
+	RandomSelect             int = iota // select randomly
+	RoundRobinSelect                    // select using Robbin algorithm
+	WeightedRoundRobinSelect            // select using smooth weighted Robbin algorithm, see weightOf
+	LeastPendingSelect                  // select the server with the fewest pending calls of the XClient
+	PowerOfTwoChoicesSelect             // select the one with fewer pending calls of 2 random servers
+	PeakEWMASelect                      // select the server with the lowest latency times calls in flight
+	ConsistentHashSelect                // select by the routing key of the call, see WithRoutingKey
 )
 
 type Discovery interface {
@@ -33,20 +41,35 @@ type MultiServersDiscovery struct {
 	r       *rand.Rand   // generate random number
 	mtx     sync.RWMutex // protect following
 	servers []string
-	index   int // record the selected position for robin algorithm
+	index   int            // record the selected position for robin algorithm
+	current map[string]int // current weights for weighted robin algorithm
+	ring    *hashRing      // for consistent hashing, built when needed, nil once servers change
+	// replicas and loadFactor configure the ring, see SetHashRing
+	replicas   int
+	loadFactor float64
+}
+
+// keyedDiscovery is implemented by the discoveries selecting servers by a routing key,
+// pending returns the pending calls to a server of the XClient asking.
+type keyedDiscovery interface {
+	GetByKey(mode int, key string, pending func(rpcAddr string) int) (string, error)
 }
 
 // NewMultiServerDiscovery creates a MultiServersDiscovery instance
 func NewMultiServerDiscovery(servers []string) *MultiServersDiscovery {
 	d := &MultiServersDiscovery{
-		servers: servers,
-		r:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		servers:    servers,
+		r:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		current:    make(map[string]int),
+		replicas:   defaultReplicas,
+		loadFactor: defaultLoadFactor,
 	}
 	d.index = d.r.Intn(math.MaxInt32 - 1)
 	return d
 }
 
 var _ Discovery = (*MultiServersDiscovery)(nil)
+var _ keyedDiscovery = (*MultiServersDiscovery)(nil)
 
 // Refresh doesn't make sense for MultiServersDiscovery, so ignore it
 func (d *MultiServersDiscovery) Refresh() error {
@@ -58,27 +81,125 @@ func (d *MultiServersDiscovery) Update(servers []string) error {
 	d.mtx.Lock()
 	defer d.mtx.Unlock()
 	d.servers = servers
+	d.ring = nil
 	return nil
 }
 
-// Get a server according to mode
+// SetHashRing configures ConsistentHashSelect: every server gets replicas virtual
+// nodes per weight on the ring, and takes at most loadFactor times the average
+// pending calls before keys move on to the next server. 0 keeps the default,
+// a loadFactor below 1 doesn't bound the load.
+func (d *MultiServersDiscovery) SetHashRing(replicas int, loadFactor float64) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if replicas > 0 {
+		d.replicas = replicas
+	}
+	if loadFactor != 0 {
+		d.loadFactor = loadFactor
+	}
+	d.ring = nil
+}
+
+// GetByKey gets a server according to mode, ConsistentHashSelect picks
+// the same server for the same key as long as the servers don't change,
+// unless the server has too many calls pending, see SetHashRing.
+func (d *MultiServersDiscovery) GetByKey(mode int, key string, pending func(rpcAddr string) int) (string, error) {
+	if mode != ConsistentHashSelect {
+		return d.Get(mode)
+	}
+	d.mtx.Lock()
+	if d.ring == nil {
+		d.ring = newHashRing(d.servers, d.replicas)
+	}
+	ring, loadFactor := d.ring, d.loadFactor
+	d.mtx.Unlock()
+	// the ring isn't changed once built, the loads are taken without holding d.mtx
+	s, ok := ring.get(key, pending, loadFactor)
+	if !ok {
+		return "", status.New(status.Unavailable, "rpc discovery: no available servers")
+	}
+	return s, nil
+}
+
+// Get a server according to mode, the modes selecting by load select randomly,
+// the load is known to the XClient only, which selects from GetAll.
 func (d *MultiServersDiscovery) Get(mode int) (string, error) {
 	d.mtx.Lock()
 	defer d.mtx.Unlock()
 	n := len(d.servers)
 	if n == 0 {
-		return "", errors.New("rpc discovery: no available servers")
+		return "", status.New(status.Unavailable, "rpc discovery: no available servers")
 	}
 	switch mode {
-	case RandomSelect:
+	case RandomSelect, ConsistentHashSelect, LeastPendingSelect, PowerOfTwoChoicesSelect, PeakEWMASelect:
 		return d.servers[d.r.Intn(n)], nil
 	case RoundRobinSelect:
 		s := d.servers[d.index%n] // servers could be updated, so mode n to ensure safety
 		d.index = (d.index + 1) % n
 		return s, nil
+	case WeightedRoundRobinSelect:
+		return d.weighted()
 	default:
-		return "", errors.New("rpc discovery: not supported select mode")
+		return "", status.New(status.InvalidArgument, "rpc discovery: not supported select mode")
+	}
+}
+
+// weighted picks a server by smooth weighted round robin: every server gains its
+// weight, the one with the most goes next and gives up the total of the weights.
+func (d *MultiServersDiscovery) weighted() (string, error) {
+	total, best := 0, ""
+	for _, s := range d.servers {
+		w := weightOf(s)
+		total += w
+		d.current[s] += w
+		if best == "" || d.current[s] > d.current[best] {
+			best = s
+		}
+	}
+	if total == 0 {
+		return "", status.New(status.Unavailable, "rpc discovery: every server has weight 0")
+	}
+	d.current[best] -= total
+	if len(d.current) > 2*len(d.servers) {
+		d.forgetWeights() // servers were updated
+	}
+	return best, nil
+}
+
+// forgetWeights drops the current weights of the servers no longer known.
+func (d *MultiServersDiscovery) forgetWeights() {
+	known := make(map[string]bool, len(d.servers))
+	for _, s := range d.servers {
+		known[s] = true
+	}
+	for s := range d.current {
+		if !known[s] {
+			delete(d.current, s)
+		}
+	}
+}
+
+// splitAddr splits rpcAddr into the address to dial and the metadata of the server,
+// which may follow as a query, eg, tcp@10.0.0.1:9999?weight=2
+func splitAddr(rpcAddr string) (string, url.Values) {
+	i := strings.IndexByte(rpcAddr, '?')
+	if i < 0 {
+		return rpcAddr, nil
+	}
+	md, _ := url.ParseQuery(rpcAddr[i+1:])
+	return rpcAddr[:i], md
+}
+
+// weightOf returns the weight given by the metadata of the server,
+// 1 if there's none, 0 takes the server out of weighted round robin.
+func weightOf(rpcAddr string) int {
+	_, md := splitAddr(rpcAddr)
+	w, err := strconv.Atoi(md.Get("weight"))
+	if err != nil || w < 0 {
+		return 1
 	}
+	return w
 }
 
 // returns all servers in discovery
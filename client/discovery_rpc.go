@@ -40,6 +40,7 @@ func (rd *RegistryDiscovery) Update(servers []string) error {
 	rd.mtx.Lock()
 	defer rd.mtx.Unlock()
 	rd.servers = servers
+	rd.ring = nil
 	rd.lastUpdate = time.Now()
 	return nil
 }
@@ -63,6 +64,7 @@ func (rd *RegistryDiscovery) Refresh() error {
 			rd.servers = append(rd.servers, strings.TrimSpace(server))
 		}
 	}
+	rd.ring = nil // the ring is rebuilt, the keys of the servers added or removed move only
 	rd.lastUpdate = time.Now()
 	return nil
 }
@@ -74,6 +76,13 @@ func (rd *RegistryDiscovery) Get(mode int) (string, error) {
 	return rd.MultiServersDiscovery.Get(mode)
 }
 
+func (rd *RegistryDiscovery) GetByKey(mode int, key string, pending func(rpcAddr string) int) (string, error) {
+	if err := rd.Refresh(); err != nil {
+		return "", err
+	}
+	return rd.MultiServersDiscovery.GetByKey(mode, key, pending)
+}
+
 func (rd *RegistryDiscovery) GetAll() ([]string, error) {
 	if err := rd.Refresh(); err != nil {
 		return nil, err
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"ToyRPC/status"
+	"math"
+	"sync"
+	"time"
+)
+
+// defaultDecay is how long it takes the latency of a server to fall
+// to 1/e of its value without new calls, or to adopt a lower latency.
+const defaultDecay = 10 * time.Second
+
+// coldLatency is the least latency a call is assumed to take. A server
+// never called, or whose latency decayed below it, costs coldLatency per
+// call, so its calls in flight still count when picking a server.
+const coldLatency = time.Millisecond
+
+// LatencyStats reports the calls XClient makes to a server.
+type LatencyStats struct {
+	EWMA     time.Duration // peak exponentially weighted moving average of the latency, decayed until now
+	InFlight int           // calls in progress
+}
+
+// latency tracks the calls to a server for PeakEWMASelect.
+type latency struct {
+	ewma     float64   // in nanoseconds
+	last     time.Time // of the last update of ewma
+	inFlight int
+}
+
+// latencies tracks the latency of the calls to every server. A call slower
+// than the average takes it over right away, a faster one weighs in by the
+// time passed since the last call, so a slow server is noticed at once.
+// Without calls the average decays, so a server that was slow gets calls again.
+type latencies struct {
+	mtx     sync.Mutex // protect following
+	decay   time.Duration
+	servers map[string]*latency
+}
+
+func newLatencies() *latencies {
+	return &latencies{decay: defaultDecay, servers: make(map[string]*latency)}
+}
+
+// get returns the latency of rpcAddr, l.mtx must be held.
+func (l *latencies) get(rpcAddr string) *latency {
+	lat, ok := l.servers[rpcAddr]
+	if !ok {
+		lat = &latency{last: time.Now()}
+		l.servers[rpcAddr] = lat
+	}
+	return lat
+}
+
+// decayed returns the average of lat decayed until now, l.mtx must be held.
+func (l *latencies) decayed(lat *latency, now time.Time) float64 {
+	return lat.ewma * math.Exp(-float64(now.Sub(lat.last))/float64(l.decay))
+}
+
+func (l *latencies) start(rpcAddr string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.get(rpcAddr).inFlight++
+}
+
+// done records a call to rpcAddr that took rtt. Calls that didn't reach
+// the server or were cancelled tell nothing about its latency, but a call
+// timing out took at least rtt.
+func (l *latencies) done(rpcAddr string, rtt time.Duration, err error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	lat := l.get(rpcAddr)
+	lat.inFlight--
+	if code := status.CodeOf(err); retryable(err) || code == status.Canceled {
+		return
+	}
+	now := time.Now()
+	ewma := l.decayed(lat, now)
+	if sample := float64(rtt); sample > ewma {
+		lat.ewma = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(lat.last)) / float64(l.decay))
+		lat.ewma = lat.ewma*w + sample*(1-w)
+	}
+	lat.last = now
+}
+
+// cost returns the decayed average latency of rpcAddr, at least coldLatency,
+// times the calls in flight and the one to come.
+func (l *latencies) cost(rpcAddr string) float64 {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	lat := l.get(rpcAddr)
+	return math.Max(l.decayed(lat, time.Now()), float64(coldLatency)) * float64(lat.inFlight+1)
+}
+
+func (l *latencies) stats() map[string]LatencyStats {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := time.Now()
+	stats := make(map[string]LatencyStats, len(l.servers))
+	for rpcAddr, lat := range l.servers {
+		stats[rpcAddr] = LatencyStats{EWMA: time.Duration(l.decayed(lat, now)), InFlight: lat.inFlight}
+	}
+	return stats
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+// FailMode tells XClient what to do when a call fails,
+// the selection mode still tells which server is called.
+type FailMode int
+
+const (
+	Failover FailMode = iota // retry on other servers, the default
+	Failfast                 // return the first error
+	Failtry                  // retry on the same server
+	Forking                  // call several servers at once, return the first success
+)
+
+// DefaultRetryPolicy is used by Failover and Failtry unless a RetryPolicy is set.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.2}
+
+// SetFailMode sets what Call does when a call fails, Failover until then.
+// Failover and Failtry retry according to the RetryPolicy, DefaultRetryPolicy
+// unless one is set. Forking calls forks servers, all of them if forks is 0,
+// a method marked non-idempotent is called on a single server though.
+func (xc *XClient) SetFailMode(mode FailMode, forks int) {
+	xc.mtx.Lock()
+	defer xc.mtx.Unlock()
+	xc.failMode, xc.forks = mode, forks
+}
+
+// fork calls up to forks servers at once, the reply of the first successful
+// call is kept and the other calls are cancelled.
+// If every call fails, the last error is returned.
+func (xc *XClient) fork(ctx context.Context, forks int, serviceMethod string, args, reply interface{}) error {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return err
+	}
+	if forks <= 0 || forks > len(servers) {
+		forks = len(servers)
+	}
+	tried := make(map[string]bool)
+	for i := 0; i < forks; i++ {
+		rpcAddr, err := xc.pick(ctx, tried)
+		if err != nil {
+			return err
+		}
+		tried[rpcAddr] = true
+	}
+
+	type result struct {
+		reply interface{}
+		err   error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // the slower calls aren't needed anymore
+	results := make(chan result, len(tried))
+	for rpcAddr := range tried {
+		go func(rpcAddr string) {
+			var clonedReply interface{}
+			if reply != nil {
+				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+			}
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			results <- result{clonedReply, err}
+		}(rpcAddr)
+	}
+	for i := 0; i < len(tried); i++ {
+		r := <-results
+		if r.err == nil {
+			if reply != nil {
+				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(r.reply).Elem())
+			}
+			return nil
+		}
+		err = r.err
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultReplicas   = 100  // virtual nodes of a server of weight 1
+	defaultLoadFactor = 1.25 // a server takes at most 25% more calls than the average
+)
+
+type routingKey struct{}
+
+// WithRoutingKey returns a context telling XClient to pick the server for key
+// when the selection mode is ConsistentHashSelect, so the calls with the same
+// key go to the same server. The calls without a key go to the server with
+// the fewest pending calls.
+func WithRoutingKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, routingKey{}, key)
+}
+
+// RoutingKeyFromContext returns the routing key of ctx, if any.
+func RoutingKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(routingKey{}).(string)
+	return key, ok
+}
+
+// hashRing maps keys to servers by consistent hashing. Every server has
+// virtual nodes on the ring, a key goes to the server of the first node
+// at or after its hash. Adding or removing a server only moves the keys
+// of its nodes.
+type hashRing struct {
+	hashes  []uint64 // of the nodes, sorted
+	servers []string // servers[i] owns hashes[i]
+	members []string // the servers with nodes, once each
+}
+
+// newHashRing places replicas nodes per weight of every server. The nodes are
+// placed by the address to dial, so changing the metadata moves only the keys
+// of the nodes added or removed for the new weight.
+func newHashRing(servers []string, replicas int) *hashRing {
+	type node struct {
+		hash   uint64
+		server string
+	}
+	var nodes []node
+	var members []string
+	seen := make(map[string]bool)
+	for _, s := range servers {
+		addr, _ := splitAddr(s)
+		n := weightOf(s) * replicas
+		for i := 0; i < n; i++ {
+			nodes = append(nodes, node{hashOf(addr + "#" + strconv.Itoa(i)), s})
+		}
+		if n > 0 && !seen[s] {
+			seen[s] = true
+			members = append(members, s)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].hash < nodes[j].hash })
+	r := &hashRing{hashes: make([]uint64, len(nodes)), servers: make([]string, len(nodes)), members: members}
+	for i, n := range nodes {
+		r.hashes[i], r.servers[i] = n.hash, n.server
+	}
+	return r
+}
+
+// get returns the server of key. With pending and a loadFactor of at least 1,
+// a server with more than loadFactor times the average pending calls is
+// passed over for the next one on the ring, so a hot key can't overload it.
+func (r *hashRing) get(key string, pending func(string) int, loadFactor float64) (string, bool) {
+	if len(r.hashes) == 0 {
+		return "", false
+	}
+	h := hashOf(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if pending == nil || loadFactor < 1 {
+		return r.servers[i%len(r.servers)], true
+	}
+	// the load of every server is taken once per lookup
+	loads := make(map[string]int, len(r.members))
+	total := 0
+	for _, s := range r.members {
+		loads[s] = pending(s)
+		total += loads[s]
+	}
+	// the call itself counts, so there's always a server below the bound
+	bound := int(math.Ceil(loadFactor * float64(total+1) / float64(len(loads))))
+	for j := 0; j < len(r.servers); j++ {
+		s := r.servers[(i+j)%len(r.servers)]
+		if loads[s] < bound {
+			return s, true
+		}
+	}
+	return r.servers[i%len(r.servers)], true
+}
+
+// hashOf hashes s by FNV-1a, mixed further so that similar strings,
+// such as the nodes of a server, scatter over the ring.
+func hashOf(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	hedgeWindow  = 10 * time.Second // the extra load is measured over that long
+	hedgeSamples = 100              // latencies kept per method for the percentile
+	minSamples   = 10               // latencies needed before the percentile is used
+)
+
+// HedgePolicy tells XClient to send another copy of a call of a method
+// marked idempotent to another server, if no reply came within the hedge delay.
+// The first reply is used, the other copies are cancelled.
+type HedgePolicy struct {
+	Delay time.Duration // the hedge delay, unless Percentile is set
+	// Percentile, in (0, 1), sets the hedge delay to that percentile of the latencies
+	// of the method, such as 0.95. Delay is used until enough calls were made.
+	Percentile float64
+	MaxHedges  int // copies per call besides the first, 0 means 1
+	// MaxExtraLoad limits the copies to that fraction of the calls of the methods
+	// hedged, such as 0.1 for 10% more calls, 0 means no limit.
+	MaxExtraLoad float64
+}
+
+// hedger hedges calls according to a HedgePolicy.
+type hedger struct {
+	policy HedgePolicy
+	mtx    sync.Mutex // protect following
+	start  time.Time  // of the current window
+	// calls and hedges made in the current and the previous window
+	calls, hedges         int
+	prevCalls, prevHedges int
+	latencies             map[string][]time.Duration // the last ones of every method
+}
+
+func newHedger(policy HedgePolicy) *hedger {
+	if policy.MaxHedges <= 0 {
+		policy.MaxHedges = 1
+	}
+	return &hedger{policy: policy, start: time.Now(), latencies: make(map[string][]time.Duration)}
+}
+
+// roll starts a new window once the current one is over, h.mtx must be held.
+func (h *hedger) roll() {
+	if time.Since(h.start) < hedgeWindow {
+		return
+	}
+	h.prevCalls, h.prevHedges = h.calls, h.hedges
+	h.calls, h.hedges = 0, 0
+	if time.Since(h.start) >= 2*hedgeWindow {
+		h.prevCalls, h.prevHedges = 0, 0 // nothing happened in the previous window
+	}
+	h.start = time.Now()
+}
+
+// delay counts a call of serviceMethod and returns its hedge delay.
+func (h *hedger) delay(serviceMethod string) time.Duration {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.roll()
+	h.calls++
+	samples := h.latencies[serviceMethod]
+	if h.policy.Percentile <= 0 || len(samples) < minSamples {
+		return h.policy.Delay
+	}
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(h.policy.Percentile*float64(len(sorted)-1))]
+}
+
+// allow takes a hedge, unless it would exceed the extra load.
+func (h *hedger) allow() bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.roll()
+	if h.policy.MaxExtraLoad > 0 &&
+		float64(h.hedges+h.prevHedges+1) > h.policy.MaxExtraLoad*float64(h.calls+h.prevCalls) {
+		return false
+	}
+	h.hedges++
+	return true
+}
+
+// record keeps the latency of a successful call of serviceMethod.
+func (h *hedger) record(serviceMethod string, latency time.Duration) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	samples := append(h.latencies[serviceMethod], latency)
+	if len(samples) > hedgeSamples {
+		samples = samples[len(samples)-hedgeSamples:]
+	}
+	h.latencies[serviceMethod] = samples
+}
+
+// hedge calls rpcAddr, and every hedge delay a server not tried yet
+// while no reply came and the policy allows. The first successful
+// reply is stored in reply and the other calls are cancelled. If every call
+// fails, the last error is returned. It returns whether a request may have been sent.
+func (xc *XClient) hedge(ctx context.Context, h *hedger, rpcAddr string, tried map[string]bool, serviceMethod string, args, reply interface{}) (bool, error) {
+	type result struct {
+		reply interface{}
+		sent  bool
+		err   error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // the slower calls aren't needed anymore
+	results := make(chan result, h.policy.MaxHedges+1)
+	send := func(rpcAddr string) {
+		tried[rpcAddr] = true
+		go func() {
+			var clonedReply interface{}
+			if reply != nil {
+				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+			}
+			start := time.Now()
+			sent, err := xc.attempt(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			if err == nil {
+				h.record(serviceMethod, time.Since(start))
+			}
+			results <- result{clonedReply, sent, err}
+		}()
+	}
+
+	delay := h.delay(serviceMethod)
+	send(rpcAddr)
+	var err error
+	inFlight, hedges, sent := 1, 0, false
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for inFlight > 0 {
+		select {
+		case <-timer.C:
+			if hedges == h.policy.MaxHedges {
+				continue
+			}
+			hedges++
+			// hedge on another server only, if the load allows it
+			if rpcAddr, err := xc.pick(ctx, tried); err == nil && !tried[rpcAddr] && h.allow() {
+				send(rpcAddr)
+				inFlight++
+			}
+			timer.Reset(delay)
+		case r := <-results:
+			inFlight--
+			sent = sent || r.sent
+			if r.err == nil {
+				if reply != nil {
+					reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(r.reply).Elem())
+				}
+				return sent, nil
+			}
+			err = r.err
+		}
+	}
+	return sent, err
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"context"
+)
+
+// Invoker performs a call.
+type Invoker func(ctx context.Context, serviceMethod string, args, reply interface{}) error
+
+// Interceptor wraps a call, for tracing, metrics, metadata injection, retries
+// and the like. It may return without calling invoker to short-circuit,
+// or pass a derived ctx carrying more metadata.
+type Interceptor func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error
+
+// EndpointInterceptor wraps a call XClient makes to the server at rpcAddr,
+// which Discovery picked.
+type EndpointInterceptor func(ctx context.Context, rpcAddr, serviceMethod string, args, reply interface{}, invoker Invoker) error
+
+// chainInterceptors returns an Invoker running interceptors in order around invoker.
+func chainInterceptors(interceptors []Interceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+			return interceptor(ctx, serviceMethod, args, reply, next)
+		}
+	}
+	return invoker
+}
+
+// chainEndpointInterceptors is chainInterceptors for the calls to rpcAddr.
+func chainEndpointInterceptors(interceptors []EndpointInterceptor, rpcAddr string, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+			return interceptor(ctx, rpcAddr, serviceMethod, args, reply, next)
+		}
+	}
+	return invoker
+}
@@ -0,0 +1,231 @@
+package client
+
+import (
+	server "ToyRPC/service"
+	"sync"
+	"time"
+)
+
+// PoolOption configures the connections XClient keeps per server.
+// The zero PoolOption keeps a single connection per server, shared by all calls.
+type PoolOption struct {
+	MinConns        int           // connections kept open per server, even when idle
+	MaxConns        int           // connections per server at most, 0 means 1
+	IdleTimeout     time.Duration // close connections idle that long, 0 means never
+	MaxCallsPerConn int           // concurrent calls on a connection before another is opened, 0 means no limit
+}
+
+// PoolStats reports the connections of a server.
+type PoolStats struct {
+	Conns      int    // open connections
+	Idle       int    // open connections without calls
+	InFlight   int    // calls in progress
+	Dials      uint64 // connections dialed so far
+	DialErrors uint64 // dials failed so far
+	Closed     uint64 // connections closed for being idle or told to go away so far
+}
+
+// pooledConn is a connection of a pool with the calls it's busy with.
+type pooledConn struct {
+	client   *Client
+	inFlight int
+	idle     time.Time // since when inFlight is 0
+}
+
+// pool keeps the connections to a server.
+type pool struct {
+	rpcAddr string
+	mtx     sync.Mutex // protect following
+	cond    *sync.Cond // signalled when a dial finishes
+	conns   []*pooledConn
+	dialing int // dials in progress, filling of them keep MinConns open
+	filling int
+	closed  bool
+	stats   PoolStats
+}
+
+func newPool(rpcAddr string) *pool {
+	p := &pool{rpcAddr: rpcAddr}
+	p.cond = sync.NewCond(&p.mtx)
+	return p
+}
+
+// get returns a connection for a call, the call must put it back.
+// The connections missing to keep MinConns open are dialed in the background
+// at once. Another connection is dialed for the call when every connection
+// has MaxCallsPerConn calls and fewer than MaxConns are open.
+// Beyond that, calls share the least busy connection.
+func (p *pool) get(popt *PoolOption, opt *server.Option) (*pooledConn, error) {
+	maxConns := popt.MaxConns
+	if maxConns < 1 {
+		maxConns = 1
+	}
+	minConns := popt.MinConns
+	if minConns > maxConns {
+		minConns = maxConns
+	}
+	p.mtx.Lock()
+	p.dropUnavailable()
+	p.fill(minConns, opt) // once, so a call doesn't wait for failing dials without end
+	for {
+		p.dropUnavailable()
+		var least *pooledConn
+		for _, pc := range p.conns {
+			if least == nil || pc.inFlight < least.inFlight {
+				least = pc
+			}
+		}
+		n := len(p.conns) + p.dialing
+		full := least == nil || popt.MaxCallsPerConn > 0 && least.inFlight >= popt.MaxCallsPerConn
+		if n < maxConns && full && (least != nil || p.filling == 0) {
+			break // dial another one
+		}
+		if least != nil {
+			least.inFlight++
+			p.mtx.Unlock()
+			return least, nil
+		}
+		p.cond.Wait() // only dials in progress, wait for one of them
+	}
+	p.dialing++
+	p.stats.Dials++
+	p.mtx.Unlock()
+
+	client, err := XDial(p.rpcAddr, opt)
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.dialing--
+	p.cond.Broadcast()
+	if err != nil {
+		p.stats.DialErrors++
+		return nil, err
+	}
+	pc := &pooledConn{client: client, inFlight: 1}
+	if p.closed {
+		// the XClient was closed meanwhile, the call still gets the
+		// connection, it's closed once the call puts it back
+		return pc, nil
+	}
+	p.conns = append(p.conns, pc)
+	return pc, nil
+}
+
+// fill dials in the background the connections missing to keep minConns open,
+// p.mtx must be held.
+func (p *pool) fill(minConns int, opt *server.Option) {
+	for n := len(p.conns) + p.dialing; n < minConns && !p.closed; n++ {
+		p.dialing++
+		p.filling++
+		p.stats.Dials++
+		go func() {
+			client, err := XDial(p.rpcAddr, opt)
+			p.mtx.Lock()
+			defer p.mtx.Unlock()
+			p.dialing--
+			p.filling--
+			p.cond.Broadcast()
+			if err != nil {
+				p.stats.DialErrors++
+				return
+			}
+			if p.closed {
+				_ = client.Close()
+				return
+			}
+			p.conns = append(p.conns, &pooledConn{client: client, idle: time.Now()})
+		}()
+	}
+}
+
+// put gives back a connection get returned.
+func (p *pool) put(pc *pooledConn) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	pc.inFlight--
+	if pc.inFlight > 0 {
+		return
+	}
+	pc.idle = time.Now()
+	if p.closed {
+		_ = pc.client.Close()
+	}
+}
+
+// dropUnavailable forgets the connections the server told to go away,
+// they still receive the responses of their pending calls, then close themselves.
+func (p *pool) dropUnavailable() {
+	conns := p.conns[:0]
+	for _, pc := range p.conns {
+		if pc.client.IsAvailable() {
+			conns = append(conns, pc)
+		} else {
+			p.stats.Closed++
+		}
+	}
+	for i := len(conns); i < len(p.conns); i++ {
+		p.conns[i] = nil
+	}
+	p.conns = conns
+}
+
+// closeIdle closes the connections idle since before deadline,
+// but keeps minConns open.
+func (p *pool) closeIdle(deadline time.Time, minConns int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.dropUnavailable()
+	conns := p.conns[:0]
+	for i, pc := range p.conns {
+		open := len(conns) + len(p.conns) - i
+		if pc.inFlight == 0 && pc.idle.Before(deadline) && open > minConns {
+			_ = pc.client.Close()
+			p.stats.Closed++
+			continue
+		}
+		conns = append(conns, pc)
+	}
+	for i := len(conns); i < len(p.conns); i++ {
+		p.conns[i] = nil
+	}
+	p.conns = conns
+}
+
+// close closes the idle connections, the busy ones as soon as their calls are done.
+func (p *pool) close() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.closed = true
+	for _, pc := range p.conns {
+		if pc.inFlight == 0 {
+			// I have no idea how to deal with error, just ignore it.
+			_ = pc.client.Close()
+		}
+	}
+	p.conns = nil
+}
+
+// pending returns the pending calls of all the connections.
+func (p *pool) pending() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	n := 0
+	for _, pc := range p.conns {
+		n += pc.client.NumPending()
+	}
+	return n
+}
+
+func (p *pool) Stats() PoolStats {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	stats := p.stats
+	stats.Conns = len(p.conns)
+	for _, pc := range p.conns {
+		stats.InFlight += pc.inFlight
+		if pc.inFlight == 0 {
+			stats.Idle++
+		}
+	}
+	return stats
+}
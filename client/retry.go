@@ -0,0 +1,123 @@
+package client
+
+import (
+	"ToyRPC/status"
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy tells XClient how to retry calls failing with a retryable error:
+// an Unavailable one, such as a dial failure, a reset connection or a server
+// shutting down. See FailMode for which server is retried.
+type RetryPolicy struct {
+	MaxAttempts    int           // attempts per call, the first included, 0 or 1 means no retry
+	InitialBackoff time.Duration // wait before the first retry
+	MaxBackoff     time.Duration // wait at most that long, 0 means no limit
+	Multiplier     float64       // the wait grows by it after every retry, 0 means 2
+	Jitter         float64       // randomize the wait by up to that fraction of it, in [0, 1]
+	// Every retryable failure takes a token of the budget, every successful call
+	// gives back BudgetRatio tokens. Calls aren't retried while at most half of
+	// BudgetTokens are left, so retries don't pile up on failing servers.
+	// 0 BudgetTokens means no budget.
+	BudgetTokens float64
+	BudgetRatio  float64
+}
+
+// retrier retries calls according to a RetryPolicy.
+type retrier struct {
+	policy RetryPolicy
+	mtx    sync.Mutex // protect following
+	tokens float64
+	r      *rand.Rand // jitter the backoff
+}
+
+func newRetrier(policy RetryPolicy) *retrier {
+	return &retrier{
+		policy: policy,
+		tokens: policy.BudgetTokens,
+		r:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// retryable reports whether a call failing with err may succeed on another server.
+func retryable(err error) bool {
+	return status.CodeOf(err) == status.Unavailable ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// record updates the budget with the outcome of an attempt.
+func (r *retrier) record(err error) {
+	if r.policy.BudgetTokens <= 0 {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err == nil {
+		r.tokens = math.Min(r.tokens+r.policy.BudgetRatio, r.policy.BudgetTokens)
+	} else if retryable(err) {
+		r.tokens = math.Max(r.tokens-1, 0)
+	}
+}
+
+// allow reports whether the budget allows another retry.
+func (r *retrier) allow() bool {
+	if r.policy.BudgetTokens <= 0 {
+		return true
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.tokens > r.policy.BudgetTokens/2
+}
+
+// backoff returns how long to wait before the nth retry, starting with 1.
+func (r *retrier) backoff(n int) time.Duration {
+	multiplier := r.policy.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	d := float64(r.policy.InitialBackoff) * math.Pow(multiplier, float64(n-1))
+	if r.policy.MaxBackoff > 0 && d > float64(r.policy.MaxBackoff) {
+		d = float64(r.policy.MaxBackoff)
+	}
+	if r.policy.Jitter > 0 {
+		r.mtx.Lock()
+		d += d * r.policy.Jitter * (2*r.r.Float64() - 1)
+		r.mtx.Unlock()
+	}
+	return time.Duration(d)
+}
+
+// wait sleeps for d, unless ctx is done first or its deadline
+// leaves no time for another attempt.
+func wait(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= d {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// retry makes the attempts of a call. attempt returns whether the request
+// may have been sent, a non-idempotent call isn't retried after that.
+// The last error is returned once no more retries are allowed.
+func (r *retrier) retry(ctx context.Context, idempotent bool, attempt func() (bool, error)) error {
+	for n := 0; ; n++ {
+		sent, err := attempt()
+		r.record(err)
+		if err == nil || !retryable(err) || sent && !idempotent ||
+			n+1 >= r.policy.MaxAttempts || !r.allow() || !wait(ctx, r.backoff(n+1)) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package client
+
+import (
+	"ToyRPC/codec"
+	"ToyRPC/metadata"
+	"ToyRPC/status"
+	"context"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ClientStream is the client side of a streaming call, see server.ServerStream.
+// The replies are read like an iterator:
+//
+//	for stream.Next() {
+//		// use reply
+//	}
+//	err := stream.Err()
+//
+// Both directions are flow controlled, so a slow stream doesn't hold up
+// the other calls on the connection: the server waits while we have
+// codec.StreamWindow replies Next hasn't taken, and Send waits until
+// the server is ready for more.
+type ClientStream struct {
+	client     *Client
+	call       *Call
+	ctx        context.Context
+	reply      reflect.Value   // where Next stores the replies, a pointer
+	sendCtx    context.Context // done when the stream has ended, for Send
+	sendCancel context.CancelFunc
+	sendWindow *codec.Window
+
+	sendMtx    sync.Mutex // protect following
+	sendClosed bool       // CloseSend was called
+
+	mtx      sync.Mutex      // protect following
+	queue    []reflect.Value // received replies not taken by Next yet
+	finished bool            // no more replies are coming
+	err      error
+	consumed int           // replies taken by Next since the last window update
+	notify   chan struct{} // signalled when a reply is queued or the stream has ended
+}
+
+// Stream calls the server streaming method serviceMethod with args.
+// Every call of Next stores the next reply in reply, which must be a pointer
+// of the type the method sends. Like Call, the outgoing metadata and
+// the remaining time of ctx are sent with the request, and ctx cancels the stream.
+// Close must be called if the stream isn't read to the end.
+func (client *Client) Stream(ctx context.Context, serviceMethod string, args, reply interface{}) (*ClientStream, error) {
+	return client.openStream(ctx, serviceMethod, args, reply)
+}
+
+// NewStream calls the client streaming or bidirectional method serviceMethod,
+// the args are sent with Send. Next returns the replies, the only one of
+// a client streaming method comes once CloseSend is called.
+func (client *Client) NewStream(ctx context.Context, serviceMethod string, reply interface{}) (*ClientStream, error) {
+	return client.openStream(ctx, serviceMethod, struct{}{}, reply)
+}
+
+func (client *Client) openStream(ctx context.Context, serviceMethod string, args, reply interface{}) (*ClientStream, error) {
+	replyv := reflect.ValueOf(reply)
+	if replyv.Kind() != reflect.Ptr || replyv.IsNil() {
+		return nil, status.New(status.InvalidArgument, "rpc client: stream reply must be a non-nil pointer")
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          make(chan *Call, 1),
+		Metadata:      md,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if call.Timeout = time.Until(deadline); call.Timeout <= 0 {
+			return nil, status.New(status.DeadlineExceeded, "rpc client: call failed: "+context.DeadlineExceeded.Error())
+		}
+	}
+	s := &ClientStream{
+		client:     client,
+		call:       call,
+		ctx:        ctx,
+		reply:      replyv,
+		sendWindow: codec.NewWindow(0), // the server grants it once it's ready
+		notify:     make(chan struct{}, 1),
+	}
+	s.sendCtx, s.sendCancel = context.WithCancel(ctx)
+	call.stream = s
+	client.goCall(call)
+	return s, nil
+}
+
+// Send sends args to the method, it waits until the server is ready for them.
+// It fails once the stream has ended, Err tells why.
+func (s *ClientStream) Send(args interface{}) error {
+	if !s.sendWindow.Acquire(s.sendCtx.Done()) {
+		return s.sendErr()
+	}
+	s.sendMtx.Lock()
+	defer s.sendMtx.Unlock()
+	if s.sendClosed {
+		return status.New(status.FailedPrecondition, "rpc client: send on a closed stream")
+	}
+	if err := s.client.write(&codec.Header{ServiceMethod: s.call.ServiceMethod, Seq: s.call.Seq, Kind: codec.KindStream}, args); err != nil {
+		return status.New(status.Unavailable, err.Error())
+	}
+	return nil
+}
+
+func (s *ClientStream) sendErr() error {
+	s.mtx.Lock()
+	err := s.err
+	s.mtx.Unlock()
+	if err == nil && s.ctx.Err() != nil {
+		st, _ := status.FromError(s.ctx.Err())
+		return status.New(st.Code, "rpc client: stream failed: "+s.ctx.Err().Error())
+	}
+	if err == nil {
+		return status.New(status.FailedPrecondition, "rpc client: send on an ended stream")
+	}
+	return err
+}
+
+// CloseSend tells the method that no more args are coming,
+// its Recv returns io.EOF. The replies can still be read.
+func (s *ClientStream) CloseSend() error {
+	s.sendMtx.Lock()
+	defer s.sendMtx.Unlock()
+	if s.sendClosed {
+		return nil
+	}
+	s.sendClosed = true
+	if s.sendCtx.Err() != nil {
+		return nil // the stream has ended
+	}
+	return s.client.write(&codec.Header{ServiceMethod: s.call.ServiceMethod, Seq: s.call.Seq, Kind: codec.KindStreamEnd}, struct{}{})
+}
+
+// Next waits for the next reply and stores it in the reply given to Stream.
+// It returns false when the stream has ended, Err tells why.
+func (s *ClientStream) Next() bool {
+	for {
+		s.mtx.Lock()
+		if len(s.queue) > 0 {
+			v := s.queue[0]
+			s.queue[0] = reflect.Value{}
+			s.queue = s.queue[1:]
+			n := 0
+			if s.consumed++; s.consumed >= codec.StreamWindow/2 && !s.finished {
+				n, s.consumed = s.consumed, 0
+			}
+			s.mtx.Unlock()
+			if n > 0 {
+				// errors are ignored, the stream fails on its own then
+				_ = s.client.write(&codec.Header{Seq: s.call.Seq, Kind: codec.KindWindow, Window: uint32(n)}, struct{}{})
+			}
+			s.reply.Elem().Set(v.Elem())
+			return true
+		}
+		finished := s.finished
+		s.mtx.Unlock()
+		if finished {
+			return false
+		}
+		select {
+		case <-s.notify:
+		case <-s.ctx.Done():
+			s.cancel()
+			st, _ := status.FromError(s.ctx.Err())
+			s.finish(status.New(st.Code, "rpc client: stream failed: "+s.ctx.Err().Error()), true)
+		}
+	}
+}
+
+// Err returns the error the stream ended with, nil if the method returned nil.
+func (s *ClientStream) Err() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.err
+}
+
+// Trailer returns the trailers the method set, once Next has returned false.
+func (s *ClientStream) Trailer() metadata.MD {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.finished {
+		return nil
+	}
+	return s.call.Trailer
+}
+
+// Close stops the stream, the server is told to stop the method.
+// It's a no-op once the stream has ended.
+func (s *ClientStream) Close() error {
+	s.mtx.Lock()
+	finished := s.finished
+	s.mtx.Unlock()
+	if !finished {
+		s.cancel()
+		s.finish(status.New(status.Canceled, "rpc client: stream closed"), true)
+	}
+	return nil
+}
+
+// cancel tells the server to stop, unless the stream has already ended.
+func (s *ClientStream) cancel() {
+	if s.client.remove(s.call.Seq) != nil {
+		s.client.sendCancel(s.call.Seq)
+		s.client.closeIfDrained()
+	}
+}
+
+// finish ends the stream with err, drop drops the replies Next hasn't taken.
+func (s *ClientStream) finish(err error, drop bool) {
+	s.mtx.Lock()
+	if !s.finished {
+		s.finished = true
+		s.err = err
+		if drop {
+			s.queue = nil
+		}
+	}
+	s.mtx.Unlock()
+	s.sendCancel()
+	s.signal()
+}
+
+func (s *ClientStream) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// push decodes the body of the current message into a new reply
+// and queues it for Next.
+func (s *ClientStream) push(cc codec.Codec) error {
+	v := reflect.New(s.reply.Type().Elem())
+	if err := cc.ReadBody(v.Interface()); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	if !s.finished {
+		s.queue = append(s.queue, v)
+	}
+	s.mtx.Unlock()
+	s.signal()
+	return nil
+}
+
+// receiveStream reads a stream message of the server,
+// it's dropped if nobody waits for it.
+func (client *Client) receiveStream(h *codec.Header) error {
+	client.mtx.Lock()
+	call := client.pending[h.Seq]
+	client.mtx.Unlock()
+	if call == nil || call.stream == nil || h.Kind != codec.KindStream {
+		if err := client.cc.ReadBody(nil); err != nil {
+			return err
+		}
+		if call != nil && call.stream != nil && h.Kind == codec.KindWindow {
+			call.stream.sendWindow.Release(int(h.Window))
+		}
+		return nil
+	}
+	if err := call.stream.push(client.cc); err != nil {
+		if call := client.remove(h.Seq); call != nil {
+			call.Err = status.New(status.Internal, "reading body "+err.Error())
+			call.done()
+		}
+		return err
+	}
+	return nil
+}
@@ -11,10 +11,12 @@ package client
 
 import (
 	server "ToyRPC/service"
+	"ToyRPC/status"
 	"context"
 	"io"
 	"reflect"
 	"sync"
+	"time"
 )
 
 type XClient struct {
@@ -22,67 +24,379 @@ type XClient struct {
 	mode    int
 	opt     *server.Option
 	mtx     sync.Mutex // protect following
-	clients map[string]*Client
+	pools   map[string]*pool
+	poolOpt PoolOption
+	reaping chan struct{} // closed to stop closing idle connections
+	retrier *retrier      // of DefaultRetryPolicy unless another RetryPolicy is set
+	// failMode tells what to do when a call fails, forks how many servers Forking calls
+	failMode FailMode
+	forks    int
+	breakers *breakers // nil unless a BreakerOption is set
+	latency  *latencies
+	balancer *balancer // for the modes selecting by load, from the calls of this XClient
+	// nonIdempotent methods aren't retried once their request may have been sent,
+	// idempotent ones may be hedged
+	nonIdempotent map[string]bool
+	idempotent    map[string]bool
+	hedger        *hedger // nil unless a HedgePolicy is set
+	// interceptors wrap Call and Broadcast, endpointInterceptors every call to a server
+	interceptors         []Interceptor
+	endpointInterceptors []EndpointInterceptor
 }
 
 var _ io.Closer = (*XClient)(nil)
 
+// NewXClient returns an XClient calling the servers d offers.
+// The modes selecting by load go by the calls of this XClient only, d may be shared.
 func NewXClient(d Discovery, mode int, opt *server.Option) *XClient {
-	return &XClient{d: d, mode: mode, opt: opt, clients: make(map[string]*Client)}
+	xc := &XClient{d: d, mode: mode, opt: opt, pools: make(map[string]*pool), retrier: newRetrier(DefaultRetryPolicy),
+		nonIdempotent: make(map[string]bool), idempotent: make(map[string]bool), latency: newLatencies()}
+	xc.balancer = newBalancer(xc.pending, xc.latency.cost)
+	return xc
+}
+
+// pending returns the pending calls to rpcAddr over all its connections.
+func (xc *XClient) pending(rpcAddr string) int {
+	xc.mtx.Lock()
+	p := xc.pools[rpcAddr]
+	xc.mtx.Unlock()
+	if p == nil {
+		return 0
+	}
+	return p.pending()
+}
+
+// SetRetryPolicy sets how Call retries the calls failing with a retryable error,
+// DefaultRetryPolicy is used until then.
+func (xc *XClient) SetRetryPolicy(policy RetryPolicy) {
+	xc.mtx.Lock()
+	defer xc.mtx.Unlock()
+	xc.retrier = newRetrier(policy)
+}
+
+// MarkNonIdempotent tells that calling the "Service.Method"s twice isn't
+// the same as calling them once, so they're retried only when the request
+// hasn't been sent, such as when dialing failed.
+func (xc *XClient) MarkNonIdempotent(serviceMethods ...string) {
+	xc.mtx.Lock()
+	defer xc.mtx.Unlock()
+	for _, serviceMethod := range serviceMethods {
+		xc.nonIdempotent[serviceMethod] = true
+		delete(xc.idempotent, serviceMethod)
+	}
+}
+
+// SetBreaker gives every server a circuit breaker, the servers whose
+// breaker is open are skipped when picking a server.
+func (xc *XClient) SetBreaker(opt BreakerOption) {
+	xc.mtx.Lock()
+	defer xc.mtx.Unlock()
+	xc.breakers = newBreakers(opt)
+}
+
+// BreakerState returns the state of the circuit breaker of rpcAddr,
+// BreakerClosed if no BreakerOption is set.
+func (xc *XClient) BreakerState(rpcAddr string) BreakerState {
+	xc.mtx.Lock()
+	bs := xc.breakers
+	xc.mtx.Unlock()
+	if bs == nil {
+		return BreakerClosed
+	}
+	return bs.state(rpcAddr)
+}
+
+// SetLatencyDecay sets how fast the latency PeakEWMASelect goes by adopts
+// lower latencies and fades without calls, 10s by default.
+func (xc *XClient) SetLatencyDecay(decay time.Duration) {
+	xc.latency.mtx.Lock()
+	defer xc.latency.mtx.Unlock()
+	if decay > 0 {
+		xc.latency.decay = decay
+	}
+}
+
+// LatencyStats returns the latency of the calls to every server called.
+func (xc *XClient) LatencyStats() map[string]LatencyStats {
+	return xc.latency.stats()
+}
+
+// MarkIdempotent tells that calling the "Service.Method"s twice is the same
+// as calling them once, such as read-only methods, so they may be hedged.
+func (xc *XClient) MarkIdempotent(serviceMethods ...string) {
+	xc.mtx.Lock()
+	defer xc.mtx.Unlock()
+	for _, serviceMethod := range serviceMethods {
+		xc.idempotent[serviceMethod] = true
+		delete(xc.nonIdempotent, serviceMethod)
+	}
+}
+
+// SetHedgePolicy makes Call hedge the calls of the methods marked idempotent.
+// With a FailMode retrying, every retry is hedged again.
+func (xc *XClient) SetHedgePolicy(policy HedgePolicy) {
+	xc.mtx.Lock()
+	defer xc.mtx.Unlock()
+	xc.hedger = newHedger(policy)
+}
+
+// SetPoolOption sets how many connections are kept per server,
+// it applies to the calls from now on.
+func (xc *XClient) SetPoolOption(popt PoolOption) {
+	xc.mtx.Lock()
+	defer xc.mtx.Unlock()
+	xc.poolOpt = popt
+	if xc.reaping != nil {
+		// the next dial starts closing idle connections at the new interval
+		close(xc.reaping)
+		xc.reaping = nil
+	}
+}
+
+// PoolStats returns the stats of the connections of every server dialed.
+func (xc *XClient) PoolStats() map[string]PoolStats {
+	xc.mtx.Lock()
+	defer xc.mtx.Unlock()
+	stats := make(map[string]PoolStats, len(xc.pools))
+	for rpcAddr, p := range xc.pools {
+		stats[rpcAddr] = p.Stats()
+	}
+	return stats
+}
+
+// Use adds interceptors wrapping every Call and Broadcast, before a server is picked.
+func (xc *XClient) Use(interceptors ...Interceptor) {
+	xc.mtx.Lock()
+	defer xc.mtx.Unlock()
+	xc.interceptors = append(xc.interceptors, interceptors...)
+}
+
+// UseEndpoint adds interceptors wrapping every call to a server,
+// they know which rpcAddr Discovery picked.
+func (xc *XClient) UseEndpoint(interceptors ...EndpointInterceptor) {
+	xc.mtx.Lock()
+	defer xc.mtx.Unlock()
+	xc.endpointInterceptors = append(xc.endpointInterceptors, interceptors...)
+}
+
+// intercept runs invoker through the interceptors added by Use.
+func (xc *XClient) intercept(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error {
+	xc.mtx.Lock()
+	interceptors := xc.interceptors
+	xc.mtx.Unlock()
+	return chainInterceptors(interceptors, invoker)(ctx, serviceMethod, args, reply)
 }
 
 func (xc *XClient) Close() error {
 	xc.mtx.Lock()
 	defer xc.mtx.Unlock()
-	for key, client := range xc.clients {
-		// I have no idea how to deal with error, just ignore it.
-		_ = client.Close()
-		delete(xc.clients, key)
+	for key, p := range xc.pools {
+		p.close()
+		delete(xc.pools, key)
+	}
+	if xc.reaping != nil {
+		close(xc.reaping)
+		xc.reaping = nil
 	}
 	return nil
 }
 
-func (xc *XClient) dial(rpcAddr string) (*Client, error) {
+// dial returns a pooled connection to rpcAddr, put it back once the call is done.
+func (xc *XClient) dial(rpcAddr string) (*pool, *pooledConn, error) {
 	xc.mtx.Lock()
-	defer xc.mtx.Unlock()
-	client, ok := xc.clients[rpcAddr]
-	if ok && !client.IsAvailable() {
-		_ = client.Close()
-		delete(xc.clients, rpcAddr)
-		client = nil
+	p, ok := xc.pools[rpcAddr]
+	if !ok {
+		p = newPool(rpcAddr)
+		xc.pools[rpcAddr] = p
 	}
-	if client == nil {
-		var err error
-		client, err = XDial(rpcAddr, xc.opt)
+	popt := xc.poolOpt
+	if popt.IdleTimeout > 0 && xc.reaping == nil {
+		xc.reaping = make(chan struct{})
+		go xc.closeIdle(popt.IdleTimeout, xc.reaping)
+	}
+	xc.mtx.Unlock()
+	pc, err := p.get(&popt, xc.opt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, pc, nil
+}
+
+// pick returns a server Discovery offers for the routing key of ctx, if any,
+// preferring one not tried yet and whose circuit breaker lets calls through.
+func (xc *XClient) pick(ctx context.Context, tried map[string]bool) (string, error) {
+	xc.mtx.Lock()
+	bs := xc.breakers
+	xc.mtx.Unlock()
+	ready := func(rpcAddr string) bool {
+		return !tried[rpcAddr] && (bs == nil || bs.ready(rpcAddr))
+	}
+	rpcAddr, err := xc.get(ctx)
+	if err != nil || ready(rpcAddr) {
+		return rpcAddr, err
+	}
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return "", err
+	}
+	// the mode may pick the same server again, give it a few more chances
+	for i := 0; i < len(servers); i++ {
+		if addr, err := xc.get(ctx); err == nil && ready(addr) {
+			return addr, nil
+		}
+	}
+	for _, addr := range servers {
+		if ready(addr) {
+			return addr, nil
+		}
+	}
+	for _, addr := range servers {
+		if !tried[addr] {
+			return addr, nil // every breaker is open, the call fails right away
+		}
+	}
+	return rpcAddr, nil // every server has been tried
+}
+
+// get returns the server the selection mode picks for ctx.
+// ConsistentHashSelect picks the least pending server for a call without a routing key.
+func (xc *XClient) get(ctx context.Context) (string, error) {
+	key, keyed := RoutingKeyFromContext(ctx)
+	mode := xc.mode
+	if mode == ConsistentHashSelect && !keyed {
+		mode = LeastPendingSelect
+	}
+	if byLoad(mode) {
+		servers, err := xc.d.GetAll()
 		if err != nil {
-			return nil, err
+			return "", err
+		}
+		if len(servers) == 0 {
+			return "", status.New(status.Unavailable, "rpc discovery: no available servers")
+		}
+		return xc.balancer.get(mode, servers), nil
+	}
+	if kd, ok := xc.d.(keyedDiscovery); ok {
+		return kd.GetByKey(mode, key, xc.pending)
+	}
+	return xc.d.Get(mode)
+}
+
+// closeIdle closes the connections idle longer than the IdleTimeout
+// of the PoolOption until stop is closed, it checks every interval.
+func (xc *XClient) closeIdle(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			xc.mtx.Lock()
+			popt := xc.poolOpt
+			pools := make([]*pool, 0, len(xc.pools))
+			for _, p := range xc.pools {
+				pools = append(pools, p)
+			}
+			xc.mtx.Unlock()
+			if popt.IdleTimeout <= 0 {
+				continue
+			}
+			for _, p := range pools {
+				p.closeIdle(now.Add(-popt.IdleTimeout), popt.MinConns)
+			}
 		}
-		xc.clients[rpcAddr] = client
 	}
-	return client, nil
 }
 
 func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	client, err := xc.dial(rpcAddr)
-	if err != nil {
-		return err
+	_, err := xc.attempt(rpcAddr, ctx, serviceMethod, args, reply)
+	return err
+}
+
+// attempt calls the server at rpcAddr, it returns whether the request may have been sent.
+func (xc *XClient) attempt(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) (bool, error) {
+	xc.mtx.Lock()
+	interceptors, bs := xc.endpointInterceptors, xc.breakers
+	xc.mtx.Unlock()
+	if bs != nil {
+		if err := bs.allow(rpcAddr); err != nil {
+			return false, err
+		}
+	}
+	sent := false
+	invoker := func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+		p, pc, err := xc.dial(rpcAddr)
+		if err != nil {
+			return status.New(status.Unavailable, err.Error())
+		}
+		defer p.put(pc)
+		return pc.client.Call(withWritten(ctx, &sent), serviceMethod, args, reply)
+	}
+	xc.latency.start(rpcAddr)
+	start := time.Now()
+	err := chainEndpointInterceptors(interceptors, rpcAddr, invoker)(ctx, serviceMethod, args, reply)
+	rtt := time.Since(start)
+	xc.latency.done(rpcAddr, rtt, err)
+	if bs != nil {
+		bs.record(rpcAddr, err, rtt)
 	}
-	return client.Call(ctx, serviceMethod, args, reply)
+	return sent, err
 }
 
 // Call invokes the named function, waits for it to complete,
 // and returns its error status.
-// xc will choose a proper server.
+// xc will choose a proper server, what happens when the call fails depends on the FailMode.
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	rpcAddr, err := xc.d.Get(xc.mode)
-	if err != nil {
-		return err
-	}
-	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+	return xc.intercept(ctx, serviceMethod, args, reply, func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+		xc.mtx.Lock()
+		r, idempotent := xc.retrier, !xc.nonIdempotent[serviceMethod]
+		mode, forks := xc.failMode, xc.forks
+		var h *hedger
+		if xc.idempotent[serviceMethod] {
+			h = xc.hedger
+		}
+		xc.mtx.Unlock()
+		if mode == Forking && idempotent {
+			return xc.fork(ctx, forks, serviceMethod, args, reply)
+		}
+		if mode == Failfast || mode == Forking {
+			rpcAddr, err := xc.pick(ctx, nil)
+			if err != nil {
+				return err
+			}
+			if h != nil {
+				_, err = xc.hedge(ctx, h, rpcAddr, make(map[string]bool), serviceMethod, args, reply)
+				return err
+			}
+			return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+		}
+		// Failtry retries the server of the first attempt, a hedged call the
+		// server of its first copy, Failover picks one not tried yet
+		var rpcAddr string
+		tried := make(map[string]bool)
+		return r.retry(ctx, idempotent, func() (bool, error) {
+			if rpcAddr == "" || mode != Failtry {
+				var err error
+				if rpcAddr, err = xc.pick(ctx, tried); err != nil {
+					return false, err
+				}
+				tried[rpcAddr] = true
+			}
+			if h != nil {
+				return xc.hedge(ctx, h, rpcAddr, tried, serviceMethod, args, reply)
+			}
+			return xc.attempt(rpcAddr, ctx, serviceMethod, args, reply)
+		})
+	})
 }
 
 // Broadcast invokes the named function for every server registered in discovery
 func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	return xc.intercept(ctx, serviceMethod, args, reply, xc.broadcast)
+}
+
+func (xc *XClient) broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
 	servers, err := xc.d.GetAll()
 	if err != nil {
 		return err
@@ -92,6 +406,7 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 	var e error
 	replyDone := reply == nil // if reply is nil, don't need to set value
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	for _, rpcAddr := range servers {
 		wg.Add(1)
 		go func(rpcAddr string) {
@@ -116,3 +431,88 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 	wg.Wait()
 	return e
 }
+
+// BroadcastResult is the outcome of the call to one server of BroadcastAll.
+type BroadcastResult struct {
+	Addr    string
+	Reply   interface{} // a new value of the type reply points to, nil if the call failed
+	Err     error
+	Latency time.Duration
+}
+
+// BroadcastAll invokes the named function for every server registered in discovery,
+// a failed call doesn't cancel the others. If quorum is 0, it waits for every
+// call, which must all succeed, and returns a result per server. Otherwise it
+// returns as soon as quorum calls succeeded, or too many failed for that, the
+// calls still running are then cancelled and their results dropped.
+// The results are in the order the calls completed, the first successful
+// reply is stored in reply.
+func (xc *XClient) BroadcastAll(ctx context.Context, serviceMethod string, args, reply interface{}, quorum int) ([]BroadcastResult, error) {
+	var results []BroadcastResult
+	err := xc.intercept(ctx, serviceMethod, args, reply, func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+		var err error
+		results, err = xc.broadcastAll(ctx, serviceMethod, args, reply, quorum)
+		return err
+	})
+	return results, err
+}
+
+func (xc *XClient) broadcastAll(ctx context.Context, serviceMethod string, args, reply interface{}, quorum int) ([]BroadcastResult, error) {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	all := quorum <= 0
+	if all {
+		quorum = len(servers)
+	}
+	if quorum > len(servers) {
+		return nil, status.Errorf(status.Unavailable, "rpc xclient: %d servers, expect %d to succeed", len(servers), quorum)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // the calls left behind aren't needed anymore
+
+	done := make(chan BroadcastResult, len(servers)) // buffered, so the calls left behind can finish
+	for _, rpcAddr := range servers {
+		go func(rpcAddr string) {
+			var clonedReply interface{}
+			if reply != nil {
+				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+			}
+			start := time.Now()
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			result := BroadcastResult{Addr: rpcAddr, Err: err, Latency: time.Since(start)}
+			if err == nil {
+				result.Reply = clonedReply
+			}
+			done <- result
+		}(rpcAddr)
+	}
+
+	results := make([]BroadcastResult, 0, len(servers))
+	succeeded := 0
+	var failed error
+	// wait for every call, or stop once the quorum is reached or out of reach
+	for len(results) < len(servers) && (all || succeeded < quorum && len(results)-succeeded <= len(servers)-quorum) {
+		result := <-done
+		results = append(results, result)
+		if result.Err != nil {
+			if failed == nil {
+				failed = result.Err
+			}
+			continue
+		}
+		if succeeded == 0 && reply != nil {
+			reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(result.Reply).Elem())
+		}
+		succeeded++
+	}
+	if succeeded < quorum {
+		if failed == nil {
+			failed = status.New(status.Unavailable, "too few servers")
+		}
+		return results, status.Errorf(status.CodeOf(failed), "rpc xclient: %d of %d servers succeeded, expect %d: %v",
+			succeeded, len(servers), quorum, failed)
+	}
+	return results, nil
+}
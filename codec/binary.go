@@ -0,0 +1,602 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/bits"
+	"reflect"
+	"sync"
+)
+
+// BinaryCodec is a codec that uses a compact, protobuf-style binary encoding.
+// Every header and body is written as a length-prefixed frame.
+// Unlike gob no type descriptors are sent, both ends derive the schema
+// of a type by reflection, see CompileSchema.
+type BinaryCodec struct {
+	connect io.ReadWriteCloser
+	buf     *bufio.Writer
+	r       *bufio.Reader
+	frame   []byte // reused by readFrame, reads are never concurrent
+	scratch []byte // reused by Write, protected by the caller's send mutex
+}
+
+var _ Codec = (*BinaryCodec)(nil) // ensure BinaryCodec implements codec
+
+// NewBinaryCodec returns a new BinaryCodec.
+func NewBinaryCodec(connect io.ReadWriteCloser) Codec {
+	return &BinaryCodec{
+		connect: connect,
+		buf:     bufio.NewWriter(connect),
+		r:       bufio.NewReader(connect),
+	}
+}
+
+// maxFrameSize protects the reader from allocating huge buffers for corrupted frames.
+const maxFrameSize = 64 << 20
+
+// ErrFrameTooLarge is returned by Write for a message the peer would refuse
+// to read, nothing is written then and the connection stays open.
+var ErrFrameTooLarge = errors.New("rpc: binary frame too large")
+
+// readFrame reads a length-prefixed frame.
+func (c *BinaryCodec) readFrame() ([]byte, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("rpc: binary frame too large: %d bytes", n)
+	}
+	if uint64(cap(c.frame)) < n {
+		c.frame = make([]byte, n)
+	}
+	frame := c.frame[:n]
+	if _, err := io.ReadFull(c.r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// ReadHeader reads the header from the connection.
+func (c *BinaryCodec) ReadHeader(h *Header) error {
+	frame, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	*h = Header{}
+	return unmarshalBinary(frame, h)
+}
+
+// ReadBody reads the body from the connection.
+// A nil body skips the frame.
+func (c *BinaryCodec) ReadBody(body interface{}) error {
+	frame, err := c.readFrame()
+	if err != nil || body == nil {
+		return err
+	}
+	return unmarshalBinary(frame, body)
+}
+
+// Write writes the header and body to the connection.
+// A frame too large for the peer isn't written, see ErrFrameTooLarge.
+func (c *BinaryCodec) Write(h *Header, body interface{}) (err error) {
+	// ensure the connection is closed if there is an error
+	defer func() {
+		// flush the buffer
+		c.buf.Flush()
+		if err != nil && !errors.Is(err, ErrFrameTooLarge) {
+			c.Close()
+		}
+	}()
+	if c.scratch, err = appendFrame(c.scratch[:0], h); err != nil {
+		log.Println("rpc: binary error encoding header:", err)
+		return
+	}
+	bodyStart := len(c.scratch)
+	if c.scratch, err = appendFrame(c.scratch, body); err != nil {
+		log.Println("rpc: binary error encoding body:", err)
+		return
+	}
+	for _, start := range []int{0, bodyStart} {
+		if n, _ := binary.Uvarint(c.scratch[start:]); n > maxFrameSize {
+			return fmt.Errorf("%w: %d bytes, over %d", ErrFrameTooLarge, n, maxFrameSize)
+		}
+	}
+	_, err = c.buf.Write(c.scratch)
+	return
+}
+
+// Close closes the connection.
+func (c *BinaryCodec) Close() error {
+	return c.connect.Close()
+}
+
+// appendFrame appends the length-prefixed encoding of v to b.
+// Length-delimited values are framed by their own length prefix.
+// A nil v is encoded as an empty frame.
+func appendFrame(b []byte, v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return appendUvarint(b, 0), nil
+	}
+	s, err := schemaOf(rv.Type())
+	if err != nil {
+		return b, err
+	}
+	start := len(b)
+	return prefixLength(s.enc(b, rv), start), nil
+}
+
+// unmarshalBinary decodes a frame into v, which must be a non-nil pointer.
+// An empty frame leaves v unchanged.
+func unmarshalBinary(frame []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("rpc: binary decode into non-pointer " + rv.Type().String())
+	}
+	if len(frame) == 0 {
+		return nil
+	}
+	s, err := schemaOf(rv.Type().Elem())
+	if err != nil {
+		return err
+	}
+	d := &binaryDecoder{buf: frame}
+	if err := s.dec(d, rv.Elem()); err != nil {
+		return err
+	}
+	if d.off != len(d.buf) {
+		return errBinaryTrailing
+	}
+	return nil
+}
+
+// wire types, the same as protobuf uses
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// binarySchema is the compiled encoder and decoder of a type.
+// For length-delimited types (wireBytes) enc and dec handle the payload only,
+// the length prefix is added by appendValue and consumed by decodeValue.
+// Every value is self-delimiting on the wire, so struct fields
+// unknown to the receiver can be skipped by their wire type.
+type binarySchema struct {
+	wire int
+	enc  func(b []byte, v reflect.Value) []byte
+	dec  func(d *binaryDecoder, v reflect.Value) error
+}
+
+// appendValue appends the self-delimiting encoding of v to b.
+func appendValue(b []byte, s *binarySchema, v reflect.Value) []byte {
+	if s.wire != wireBytes {
+		return s.enc(b, v)
+	}
+	start := len(b)
+	return prefixLength(s.enc(b, v), start)
+}
+
+var (
+	schemaCache sync.Map   // reflect.Type -> *binarySchema
+	schemaMtx   sync.Mutex // serialize compiling, so recursive types are built once
+)
+
+// CompileSchema derives the binary schema of t and caches it.
+// The server calls it for argument and reply types when a service
+// is registered, other types are compiled lazily on first use.
+func CompileSchema(t reflect.Type) error {
+	_, err := schemaOf(t)
+	return err
+}
+
+func schemaOf(t reflect.Type) (*binarySchema, error) {
+	if s, ok := schemaCache.Load(t); ok {
+		return s.(*binarySchema), nil
+	}
+	schemaMtx.Lock()
+	defer schemaMtx.Unlock()
+	building := make(map[reflect.Type]*binarySchema)
+	s, err := buildSchema(t, building)
+	if err != nil {
+		return nil, err
+	}
+	// only publish complete schemas, a failed build leaves the cache untouched
+	for t, s := range building {
+		schemaCache.Store(t, s)
+	}
+	return s, nil
+}
+
+func buildSchema(t reflect.Type, building map[reflect.Type]*binarySchema) (*binarySchema, error) {
+	if s, ok := schemaCache.Load(t); ok {
+		return s.(*binarySchema), nil
+	}
+	if s, ok := building[t]; ok {
+		return s, nil // recursive type, s is filled in by the outer call
+	}
+	wire, err := wireOf(t)
+	if err != nil {
+		return nil, err
+	}
+	// the wire type is set before building, a recursive type refers to s
+	// through a pointer and needs it while s itself is still incomplete
+	s := &binarySchema{wire: wire}
+	building[t] = s
+	switch t.Kind() {
+	case reflect.Bool:
+		s.enc = func(b []byte, v reflect.Value) []byte {
+			if v.Bool() {
+				return append(b, 1)
+			}
+			return append(b, 0)
+		}
+		s.dec = func(d *binaryDecoder, v reflect.Value) error {
+			x, err := d.uvarint()
+			v.SetBool(x != 0)
+			return err
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s.enc = func(b []byte, v reflect.Value) []byte {
+			return appendVarint(b, v.Int())
+		}
+		s.dec = func(d *binaryDecoder, v reflect.Value) error {
+			x, err := d.varint()
+			if err == nil && v.OverflowInt(x) {
+				return fmt.Errorf("rpc: binary value %d overflows %s", x, v.Type())
+			}
+			v.SetInt(x)
+			return err
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		s.enc = func(b []byte, v reflect.Value) []byte {
+			return appendUvarint(b, v.Uint())
+		}
+		s.dec = func(d *binaryDecoder, v reflect.Value) error {
+			x, err := d.uvarint()
+			if err == nil && v.OverflowUint(x) {
+				return fmt.Errorf("rpc: binary value %d overflows %s", x, v.Type())
+			}
+			v.SetUint(x)
+			return err
+		}
+	case reflect.Float32, reflect.Float64:
+		// floats are sent as byte-reversed varints like gob does,
+		// so the common values with short mantissas take few bytes
+		s.enc = func(b []byte, v reflect.Value) []byte {
+			return appendUvarint(b, bits.ReverseBytes64(math.Float64bits(v.Float())))
+		}
+		s.dec = func(d *binaryDecoder, v reflect.Value) error {
+			x, err := d.uvarint()
+			f := math.Float64frombits(bits.ReverseBytes64(x))
+			if err == nil && v.OverflowFloat(f) {
+				return fmt.Errorf("rpc: binary value %g overflows %s", f, v.Type())
+			}
+			v.SetFloat(f)
+			return err
+		}
+	case reflect.String:
+		s.enc = func(b []byte, v reflect.Value) []byte {
+			return append(b, v.String()...)
+		}
+		s.dec = func(d *binaryDecoder, v reflect.Value) error {
+			v.SetString(string(d.rest()))
+			return nil
+		}
+	case reflect.Ptr:
+		es, err := buildSchema(t.Elem(), building)
+		if err != nil {
+			return nil, err
+		}
+		// a nil pointer is sent as the zero value of its element
+		zero := reflect.Zero(t.Elem())
+		s.enc = func(b []byte, v reflect.Value) []byte {
+			if v.IsNil() {
+				return es.enc(b, zero)
+			}
+			return es.enc(b, v.Elem())
+		}
+		s.dec = func(d *binaryDecoder, v reflect.Value) error {
+			if v.IsNil() {
+				v.Set(reflect.New(t.Elem()))
+			}
+			return es.dec(d, v.Elem())
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			s.enc = func(b []byte, v reflect.Value) []byte {
+				return append(b, v.Bytes()...)
+			}
+			s.dec = func(d *binaryDecoder, v reflect.Value) error {
+				v.SetBytes(append([]byte{}, d.rest()...)) // the frame is reused
+				return nil
+			}
+			break
+		}
+		fallthrough
+	case reflect.Array:
+		es, err := buildSchema(t.Elem(), building)
+		if err != nil {
+			return nil, err
+		}
+		s.enc = func(b []byte, v reflect.Value) []byte {
+			b = appendUvarint(b, uint64(v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				b = appendValue(b, es, v.Index(i))
+			}
+			return b
+		}
+		s.dec = func(d *binaryDecoder, v reflect.Value) error {
+			n, err := d.count()
+			if err != nil {
+				return err
+			}
+			if t.Kind() == reflect.Slice {
+				v.Set(reflect.MakeSlice(t, n, n))
+			} else if n > v.Len() {
+				return fmt.Errorf("rpc: binary array of %d elements overflows %s", n, t)
+			}
+			for i := 0; i < n; i++ {
+				if err := d.decodeValue(es, v.Index(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case reflect.Map:
+		ks, err := buildSchema(t.Key(), building)
+		if err != nil {
+			return nil, err
+		}
+		vs, err := buildSchema(t.Elem(), building)
+		if err != nil {
+			return nil, err
+		}
+		s.enc = func(b []byte, v reflect.Value) []byte {
+			b = appendUvarint(b, uint64(v.Len()))
+			iter := v.MapRange()
+			for iter.Next() {
+				b = appendValue(b, ks, iter.Key())
+				b = appendValue(b, vs, iter.Value())
+			}
+			return b
+		}
+		zeroKey, zeroElem := reflect.Zero(t.Key()), reflect.Zero(t.Elem())
+		s.dec = func(d *binaryDecoder, v reflect.Value) error {
+			n, err := d.count()
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.MakeMapWithSize(t, n))
+			// SetMapIndex copies, so key and elem are reused for every entry
+			key := reflect.New(t.Key()).Elem()
+			elem := reflect.New(t.Elem()).Elem()
+			for i := 0; i < n; i++ {
+				key.Set(zeroKey)
+				elem.Set(zeroElem)
+				if err := d.decodeValue(ks, key); err != nil {
+					return err
+				}
+				if err := d.decodeValue(vs, elem); err != nil {
+					return err
+				}
+				v.SetMapIndex(key, elem)
+			}
+			return nil
+		}
+	case reflect.Struct:
+		if err := buildStructSchema(s, t, building); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("rpc: binary codec does not support type " + t.String())
+	}
+	return s, nil
+}
+
+// wireOf returns the wire type of t, a pointer has the wire type of its element.
+func wireOf(t reflect.Type) (int, error) {
+	for seen := make(map[reflect.Type]bool); t.Kind() == reflect.Ptr; t = t.Elem() {
+		if seen[t] {
+			return 0, errors.New("rpc: binary codec does not support type " + t.String())
+		}
+		seen[t] = true
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return wireVarint, nil
+	}
+	return wireBytes, nil
+}
+
+// buildStructSchema encodes every exported field as a (tag, value) pair,
+// where the tag holds the field number (its index + 1) and its wire type.
+// Zero fields are omitted. New fields must be appended to the struct,
+// so the numbers of existing fields stay the same.
+func buildStructSchema(s *binarySchema, t reflect.Type, building map[reflect.Type]*binarySchema) error {
+	type field struct {
+		index  int
+		tag    uint64
+		schema *binarySchema
+	}
+	var fields []field
+	byNumber := make(map[uint64]field)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue // field must be exported
+		}
+		fs, err := buildSchema(sf.Type, building)
+		if err != nil {
+			return fmt.Errorf("%v (field %s.%s)", err, t, sf.Name)
+		}
+		f := field{index: i, tag: uint64(i+1) << 3, schema: fs}
+		fields = append(fields, f)
+		byNumber[uint64(i+1)] = f
+	}
+	s.enc = func(b []byte, v reflect.Value) []byte {
+		for _, f := range fields {
+			fv := v.Field(f.index)
+			if fv.IsZero() {
+				continue
+			}
+			b = appendUvarint(b, f.tag|uint64(f.schema.wire))
+			b = appendValue(b, f.schema, fv)
+		}
+		return b
+	}
+	s.dec = func(d *binaryDecoder, v reflect.Value) error {
+		for d.off < len(d.buf) {
+			tag, err := d.uvarint()
+			if err != nil {
+				return err
+			}
+			f, ok := byNumber[tag>>3]
+			if !ok || int(tag&7) != f.schema.wire {
+				// unknown to this side, skip it
+				if err := d.skip(int(tag & 7)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decodeValue(f.schema, v.Field(f.index)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	for x >= 0x80 {
+		b = append(b, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(b, byte(x))
+}
+
+func appendVarint(b []byte, x int64) []byte {
+	ux := uint64(x) << 1 // zigzag, the same as binary.PutVarint
+	if x < 0 {
+		ux = ^ux
+	}
+	return appendUvarint(b, ux)
+}
+
+// prefixLength inserts the length of b[start:] in front of it.
+func prefixLength(b []byte, start int) []byte {
+	var p [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(p[:], uint64(len(b)-start))
+	b = append(b, p[:n]...)
+	copy(b[start+n:], b[start:len(b)-n])
+	copy(b[start:], p[:n])
+	return b
+}
+
+var (
+	errBinaryShort    = errors.New("rpc: binary frame is truncated")
+	errBinaryTrailing = errors.New("rpc: binary payload has trailing bytes")
+)
+
+// binaryDecoder reads values from a frame.
+type binaryDecoder struct {
+	buf []byte
+	off int
+}
+
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	x, n := binary.Uvarint(d.buf[d.off:])
+	if n <= 0 {
+		return 0, errBinaryShort
+	}
+	d.off += n
+	return x, nil
+}
+
+func (d *binaryDecoder) varint() (int64, error) {
+	x, n := binary.Varint(d.buf[d.off:])
+	if n <= 0 {
+		return 0, errBinaryShort
+	}
+	d.off += n
+	return x, nil
+}
+
+// bytes returns a length-prefixed byte slice, which aliases the frame.
+func (d *binaryDecoder) bytes() ([]byte, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.buf)-d.off) {
+		return nil, errBinaryShort
+	}
+	p := d.buf[d.off : d.off+int(n)]
+	d.off += int(n)
+	return p, nil
+}
+
+// rest consumes the remaining bytes of a payload.
+func (d *binaryDecoder) rest() []byte {
+	p := d.buf[d.off:]
+	d.off = len(d.buf)
+	return p
+}
+
+// count reads the number of elements of a slice, array or map.
+// Every element takes at least one byte, which bounds the allocation.
+func (d *binaryDecoder) count() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.buf)-d.off) {
+		return 0, errBinaryShort
+	}
+	return int(n), nil
+}
+
+// decodeValue decodes a value written by appendValue.
+// Length-delimited payloads are decoded in place, bounded to their length.
+func (d *binaryDecoder) decodeValue(s *binarySchema, v reflect.Value) error {
+	if s.wire != wireBytes {
+		return s.dec(d, v)
+	}
+	p, err := d.bytes()
+	if err != nil {
+		return err
+	}
+	buf, off := d.buf, d.off
+	d.buf, d.off = p, 0
+	err = s.dec(d, v)
+	if err == nil && d.off != len(d.buf) {
+		err = errBinaryTrailing
+	}
+	d.buf, d.off = buf, off
+	return err
+}
+
+// skip skips a value of the given wire type.
+func (d *binaryDecoder) skip(wire int) error {
+	var err error
+	switch wire {
+	case wireVarint:
+		_, err = d.uvarint()
+	case wireBytes:
+		_, err = d.bytes()
+	default:
+		err = fmt.Errorf("rpc: binary unknown wire type %d", wire)
+	}
+	return err
+}
@@ -1,17 +1,40 @@
 package codec
 
-import "io"
+import (
+	"io"
+	"time"
+)
+
+const (
+	GobType    string = "application/gob"
+	JsonType   string = "application/json"
+	BinaryType string = "application/x-toyrpc-binary"
+)
+
+// MessageKind tells the peer how to treat a message.
+type MessageKind uint8
 
 const (
-	GobType  string = "application/gob"
-	JsonType string = "application/json" // not implemented
+	KindCall      MessageKind = iota // a request, or the response to it
+	KindCancel                       // the client gave up on the request with the same Seq
+	KindGoAway                       // the server is shutting down, send no new requests
+	KindStream                       // one reply of a streaming method to the request with the same Seq
+	KindStreamEnd                    // end of the stream, with the error and trailers of the method
+	KindWindow                       // the receiver of the stream with the same Seq is ready for Window more messages
 )
 
 // Header is the header of a message.
+// New fields must be appended, BinaryCodec numbers them by position.
 type Header struct {
 	ServiceMethod string
 	Seq           uint64
 	Error         string
+	Metadata      map[string]string // request metadata, or trailers of a response
+	Kind          MessageKind       // control messages carry an empty body
+	Timeout       time.Duration     // remaining time of the caller's deadline, 0 means none
+	Code          uint32            // status.Code of Error, 0 if there's none
+	Details       map[string]string // optional details of Error
+	Window        uint32            // messages granted by KindWindow
 }
 
 // NewCodecFunc is a function that creates a new Codec.
@@ -30,4 +53,6 @@ var NewCodecFuncMap map[string]NewCodecFunc
 func init() {
 	NewCodecFuncMap = make(map[string]NewCodecFunc)
 	NewCodecFuncMap[GobType] = NewGobCodec
+	NewCodecFuncMap[JsonType] = NewJsonCodec
+	NewCodecFuncMap[BinaryType] = NewBinaryCodec
 }
@@ -0,0 +1,228 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	CompressNone string = ""
+	CompressGzip string = "gzip"
+	CompressFast string = "deflate-fast" // favours speed, in the spirit of snappy
+	CompressBest string = "deflate-best" // favours ratio, in the spirit of zstd
+)
+
+// DefaultCompressThreshold is used when the threshold given to
+// NewCompressCodecFunc is 0. Smaller frames rarely shrink.
+const DefaultCompressThreshold = 1024
+
+// Compressor compresses a whole frame at once.
+type Compressor interface {
+	Compress(p []byte) ([]byte, error)
+	Decompress(p []byte) ([]byte, error)
+}
+
+// CompressorMap is a map from a compression name to its Compressor.
+// Pure Go snappy or zstd implementations can be registered here.
+var CompressorMap = map[string]Compressor{
+	CompressGzip: newFlateCompressor(gzip.DefaultCompression, true),
+	CompressFast: newFlateCompressor(flate.BestSpeed, false),
+	CompressBest: newFlateCompressor(flate.BestCompression, false),
+}
+
+// NewCompressCodecFunc wraps newCodec, so that every message it writes
+// is sent as one frame, compressed by the named Compressor
+// when it is at least threshold bytes long.
+func NewCompressCodecFunc(newCodec NewCodecFunc, compress string, threshold int) (NewCodecFunc, error) {
+	if compress == CompressNone {
+		return newCodec, nil
+	}
+	c := CompressorMap[compress]
+	if c == nil {
+		return nil, fmt.Errorf("rpc: compressor not found: %s", compress)
+	}
+	if threshold == 0 {
+		threshold = DefaultCompressThreshold
+	}
+	return func(connect io.ReadWriteCloser) Codec {
+		conn := &compressConn{
+			connect:   connect,
+			r:         bufio.NewReader(connect),
+			c:         c,
+			threshold: threshold,
+		}
+		return &CompressCodec{Codec: newCodec(conn), conn: conn}
+	}, nil
+}
+
+// CompressCodec wraps another codec and compresses what it writes.
+type CompressCodec struct {
+	Codec
+	conn *compressConn
+}
+
+var _ Codec = (*CompressCodec)(nil) // ensure CompressCodec implements codec
+
+// Write writes the header and body with the wrapped codec,
+// then sends them to the connection as a single frame.
+func (c *CompressCodec) Write(h *Header, body interface{}) error {
+	if err := c.Codec.Write(h, body); err != nil {
+		c.conn.wbuf.Reset()
+		return err
+	}
+	return c.conn.flush()
+}
+
+// frame flags
+const (
+	frameRaw        byte = 0
+	frameCompressed byte = 1
+)
+
+// compressConn sits between a codec and the connection.
+// A frame is a flag byte, the uvarint length of the payload and the payload.
+// The flag tells whether the payload is compressed, so the peer can
+// decode mixed frames regardless of the threshold it uses itself.
+type compressConn struct {
+	connect   io.ReadWriteCloser
+	r         *bufio.Reader
+	c         Compressor
+	threshold int
+	wbuf      bytes.Buffer // message being written, protected by the caller's send mutex
+	rbuf      []byte       // unread bytes of the last frame
+}
+
+func (conn *compressConn) Read(p []byte) (int, error) {
+	for len(conn.rbuf) == 0 {
+		if err := conn.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, conn.rbuf)
+	conn.rbuf = conn.rbuf[n:]
+	return n, nil
+}
+
+func (conn *compressConn) readFrame() error {
+	flag, err := conn.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	n, err := binary.ReadUvarint(conn.r)
+	if err != nil {
+		return err
+	}
+	if n > maxFrameSize {
+		return fmt.Errorf("rpc: compressed frame too large: %d bytes", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(conn.r, payload); err != nil {
+		return err
+	}
+	switch flag {
+	case frameRaw:
+		conn.rbuf = payload
+	case frameCompressed:
+		conn.rbuf, err = conn.c.Decompress(payload)
+	default:
+		err = fmt.Errorf("rpc: unknown frame flag %d", flag)
+	}
+	return err
+}
+
+// Write buffers the bytes of the message, flush sends them.
+func (conn *compressConn) Write(p []byte) (int, error) {
+	return conn.wbuf.Write(p)
+}
+
+func (conn *compressConn) flush() error {
+	defer conn.wbuf.Reset()
+	flag, payload := frameRaw, conn.wbuf.Bytes()
+	if len(payload) >= conn.threshold {
+		compressed, err := conn.c.Compress(payload)
+		if err != nil {
+			return err
+		}
+		if len(compressed) < len(payload) { // incompressible data is sent raw
+			flag, payload = frameCompressed, compressed
+		}
+	}
+	frame := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+len(payload))
+	frame[0] = flag
+	frame = append(frame[:1+binary.PutUvarint(frame[1:], uint64(len(payload)))], payload...)
+	_, err := conn.connect.Write(frame)
+	return err
+}
+
+func (conn *compressConn) Close() error {
+	return conn.connect.Close()
+}
+
+// flateCompressor implements gzip and raw deflate, reusing writers.
+type flateCompressor struct {
+	level   int
+	gzip    bool
+	writers sync.Pool
+}
+
+func newFlateCompressor(level int, gzip bool) *flateCompressor {
+	return &flateCompressor{level: level, gzip: gzip}
+}
+
+type flateWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+func (f *flateCompressor) Compress(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := f.writers.Get().(flateWriter)
+	var err error
+	if w != nil {
+		w.Reset(&buf)
+	} else if f.gzip {
+		w, err = gzip.NewWriterLevel(&buf, f.level)
+	} else {
+		w, err = flate.NewWriter(&buf, f.level)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	f.writers.Put(w)
+	return buf.Bytes(), nil
+}
+
+var errDecompressedTooLarge = errors.New("rpc: decompressed frame too large")
+
+func (f *flateCompressor) Decompress(p []byte) ([]byte, error) {
+	var r io.ReadCloser
+	if f.gzip {
+		gr, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	} else {
+		r = flate.NewReader(bytes.NewReader(p))
+	}
+	defer r.Close()
+	// limit the output, a tiny frame may expand to gigabytes
+	out, err := io.ReadAll(io.LimitReader(r, maxFrameSize+1))
+	if err == nil && len(out) > maxFrameSize {
+		err = errDecompressedTooLarge
+	}
+	return out, err
+}
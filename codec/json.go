@@ -0,0 +1,76 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+)
+
+// JsonCodec is a codec that uses json to encode/decode.
+// Every header and body is written as a standalone json value,
+// so the traffic stays readable for non-Go tooling.
+type JsonCodec struct {
+	connect io.ReadWriteCloser
+	buf     *bufio.Writer
+	dec     *json.Decoder
+	enc     *json.Encoder
+}
+
+var _ Codec = (*JsonCodec)(nil) // ensure JsonCodec implements codec
+
+// NewJsonCodec returns a new JsonCodec.
+func NewJsonCodec(connect io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(connect)
+	dec := json.NewDecoder(connect)
+	// keep numbers as json.Number when decoding into interface{},
+	// otherwise large integers are silently rounded to float64
+	dec.UseNumber()
+	return &JsonCodec{
+		connect: connect,
+		buf:     buf,
+		dec:     dec,
+		enc:     json.NewEncoder(buf),
+	}
+}
+
+// ReadHeader reads the header from the connection.
+func (c *JsonCodec) ReadHeader(h *Header) error {
+	return c.dec.Decode(h)
+}
+
+// ReadBody reads the body from the connection.
+// A nil body drains the next value, so the stream stays in sync.
+func (c *JsonCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		var discard json.RawMessage
+		return c.dec.Decode(&discard)
+	}
+	return c.dec.Decode(body)
+}
+
+// Write writes the header and body to the connection.
+func (c *JsonCodec) Write(h *Header, body interface{}) (err error) {
+	// ensure the connection is closed if there is an error
+	defer func() {
+		// flush the buffer
+		c.buf.Flush()
+		if err != nil {
+			c.Close()
+		}
+	}()
+	if err = c.enc.Encode(h); err != nil {
+		log.Println("rpc: json error encoding header:", err)
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		log.Println("rpc: json error encoding body:", err)
+		return
+	}
+	return
+}
+
+// Close closes the connection.
+func (c *JsonCodec) Close() error {
+	return c.connect.Close()
+}
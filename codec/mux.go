@@ -0,0 +1,444 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// DefaultChunkSize is used when the chunk size given to NewMuxCodecFunc is 0.
+	DefaultChunkSize = 16 << 10
+	// muxWindow is how many bytes of one Seq may be on their way
+	// before the receiver grants more.
+	muxWindow = 256 << 10
+	// muxMaxBuffered is how many bytes of received messages and parts of
+	// messages may wait for the reader of the codec before the receiver stops
+	// granting, whatever their Seq. One message at a time is still granted
+	// then, so that it completes and the reader can take it.
+	muxMaxBuffered = 4 << 20
+)
+
+// chunk kinds
+const (
+	chunkData   byte = 0 // a part of a message
+	chunkLast   byte = 1 // the last part of a message
+	chunkWindow byte = 2 // the receiver grants more bytes for the Seq
+)
+
+// NewMuxCodecFunc wraps newCodec, so that every message is split into chunks
+// of at most chunkSize bytes, interleaved with the chunks of the other Seqs.
+// A multi-megabyte reply then no longer holds up the small calls next to it.
+// Every Seq is flow controlled on its own, the chunks of the Seqs that may
+// send are written in turns.
+//
+// Each message is encoded on its own, as the messages of different Seqs
+// may arrive in another order than they were written. That costs the gob
+// codec its type information in every message.
+func NewMuxCodecFunc(newCodec NewCodecFunc, chunkSize int) NewCodecFunc {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	return func(connect io.ReadWriteCloser) Codec {
+		c := &MuxCodec{
+			connect:   connect,
+			newCodec:  newCodec,
+			chunkSize: chunkSize,
+			r:         bufio.NewReader(connect),
+			w:         bufio.NewWriter(connect),
+			sends:     make(map[uint64]*muxSend),
+			partial:   make(map[uint64][]byte),
+			grants:    make(map[uint64]int),
+		}
+		c.cond = sync.NewCond(&c.mtx)
+		go c.writeLoop()
+		go c.readLoop()
+		return c
+	}
+}
+
+// MuxCodec multiplexes the messages of a connection by Seq.
+// Its Write may be called concurrently, see SendLocker.
+type MuxCodec struct {
+	connect   io.ReadWriteCloser
+	newCodec  NewCodecFunc
+	chunkSize int
+	r         *bufio.Reader // used by readLoop only
+	w         *bufio.Writer // used by writeLoop only
+	cur       Codec         // decodes the message ReadHeader took, used by the reader of the codec only
+
+	mtx      sync.Mutex // protect following
+	cond     *sync.Cond // signalled when any of the following changes
+	sends    map[uint64]*muxSend
+	order    []uint64          // Seqs with messages to send, in turns
+	control  [][]byte          // window chunks to send first
+	partial  map[uint64][]byte // received parts of messages
+	messages [][]byte          // received messages the reader of the codec hasn't taken
+	buffered int               // bytes of the messages and parts not taken yet
+	grants   map[uint64]int    // grants held back while too much is buffered
+	err      error             // the connection failed or was closed
+	// progress is the Seq still granted while too much is buffered, if progressing
+	progress    uint64
+	progressing bool
+}
+
+var _ Codec = (*MuxCodec)(nil) // ensure MuxCodec implements codec
+
+// muxSend is the sending state of a Seq.
+type muxSend struct {
+	window  int // bytes the receiver is ready for
+	queue   []*muxMessage
+	written int // bytes of queue[0] already sent
+}
+
+// muxMessage is an encoded message waiting to be sent.
+type muxMessage struct {
+	data []byte
+	done chan error
+}
+
+// ReadHeader waits for the next complete message and reads its header.
+func (c *MuxCodec) ReadHeader(h *Header) error {
+	c.mtx.Lock()
+	for len(c.messages) == 0 && c.err == nil {
+		c.cond.Wait()
+	}
+	if len(c.messages) == 0 {
+		err := c.err
+		c.mtx.Unlock()
+		return err
+	}
+	data := c.messages[0]
+	c.messages[0] = nil
+	c.messages = c.messages[1:]
+	c.buffered -= len(data)
+	if c.buffered <= muxMaxBuffered && len(c.grants) > 0 {
+		for seq := range c.grants {
+			c.release(seq)
+		}
+		c.progressing = false
+		c.cond.Broadcast()
+	}
+	c.mtx.Unlock()
+	c.cur = c.newCodec(&messageConn{Reader: bytes.NewReader(data)})
+	return c.cur.ReadHeader(h)
+}
+
+// ReadBody reads the body of the message ReadHeader took.
+func (c *MuxCodec) ReadBody(body interface{}) error {
+	if c.cur == nil {
+		return errors.New("rpc: mux codec: ReadBody without a header")
+	}
+	return c.cur.ReadBody(body)
+}
+
+// Write encodes the message and waits until it's sent, while the messages
+// of other Seqs are sent alongside.
+func (c *MuxCodec) Write(h *Header, body interface{}) error {
+	var buf bytes.Buffer
+	if err := c.newCodec(&messageConn{Writer: &buf}).Write(h, body); err != nil {
+		return err
+	}
+	m := &muxMessage{data: buf.Bytes(), done: make(chan error, 1)}
+	c.mtx.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mtx.Unlock()
+		return err
+	}
+	s := c.sends[h.Seq]
+	if s == nil {
+		s = &muxSend{window: muxWindow}
+		c.sends[h.Seq] = s
+	}
+	if len(s.queue) == 0 {
+		c.order = append(c.order, h.Seq)
+	}
+	s.queue = append(s.queue, m)
+	c.cond.Broadcast()
+	c.mtx.Unlock()
+	return <-m.done
+}
+
+// Close closes the connection, messages not sent yet fail.
+func (c *MuxCodec) Close() error {
+	c.fail(io.ErrClosedPipe)
+	return c.connect.Close()
+}
+
+// fail stops the codec with err, unless it has already failed.
+func (c *MuxCodec) fail(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	for seq, s := range c.sends {
+		for _, m := range s.queue {
+			m.done <- err
+		}
+		delete(c.sends, seq)
+	}
+	c.order = nil
+	c.cond.Broadcast()
+}
+
+// next returns the next chunk to send and the message it completes, if any.
+// It waits until there is one, it returns nil once the codec has failed.
+func (c *MuxCodec) next() ([]byte, *muxMessage) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for c.err == nil {
+		if len(c.control) > 0 {
+			chunk := c.control[0]
+			c.control[0] = nil
+			c.control = c.control[1:]
+			return chunk, nil
+		}
+		for i, seq := range c.order {
+			s := c.sends[seq]
+			if s.window == 0 {
+				continue
+			}
+			m := s.queue[0]
+			n := len(m.data) - s.written
+			if n > c.chunkSize {
+				n = c.chunkSize
+			}
+			if n > s.window {
+				n = s.window
+			}
+			kind := chunkData
+			if s.written+n == len(m.data) {
+				kind = chunkLast
+			}
+			chunk := dataChunk(kind, seq, m.data[s.written:s.written+n])
+			s.window -= n
+			s.written += n
+			// take turns: this Seq goes to the back, or leaves once it's done
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			if kind != chunkLast {
+				c.order = append(c.order, seq)
+				return chunk, nil
+			}
+			s.queue[0] = nil
+			s.queue = s.queue[1:]
+			s.written = 0
+			if len(s.queue) > 0 {
+				c.order = append(c.order, seq)
+			} else if s.window == muxWindow {
+				delete(c.sends, seq) // nothing granted is outstanding
+			}
+			return chunk, m
+		}
+		c.cond.Wait()
+	}
+	return nil, nil
+}
+
+// pending reports whether a chunk is ready to be sent.
+func (c *MuxCodec) pending() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.control) > 0 {
+		return true
+	}
+	for _, seq := range c.order {
+		if c.sends[seq].window > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// writeLoop sends the chunks, it flushes the connection
+// whenever nothing else is ready to be sent.
+func (c *MuxCodec) writeLoop() {
+	var sent []*muxMessage // written, but not flushed yet
+	for {
+		chunk, m := c.next()
+		if chunk == nil {
+			c.mtx.Lock()
+			err := c.err
+			c.mtx.Unlock()
+			for _, m := range sent {
+				m.done <- err
+			}
+			return
+		}
+		_, err := c.w.Write(chunk)
+		if m != nil {
+			sent = append(sent, m)
+		}
+		if err == nil && !c.pending() {
+			err = c.w.Flush()
+			for _, m := range sent {
+				m.done <- err
+			}
+			sent = sent[:0]
+		}
+		if err != nil {
+			for _, m := range sent {
+				m.done <- err
+			}
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// release sends the grants held back for seq, c.mtx must be held.
+func (c *MuxCodec) release(seq uint64) {
+	if n := c.grants[seq]; n > 0 {
+		c.control = append(c.control, windowChunk(seq, n))
+	}
+	delete(c.grants, seq)
+}
+
+// nextProgress lets another partly received message go on, if too much is
+// buffered still, so that it completes as well. c.mtx must be held.
+func (c *MuxCodec) nextProgress() {
+	c.progressing = false
+	if c.buffered <= muxMaxBuffered {
+		return
+	}
+	for seq := range c.partial {
+		if c.grants[seq] > 0 {
+			c.progress, c.progressing = seq, true
+			c.release(seq)
+			return
+		}
+	}
+}
+
+// readLoop receives the chunks, it grants the bytes of a Seq back
+// as soon as they arrive, unless too much is waiting for the reader.
+// A message growing past maxFrameSize, or a Seq sending more than
+// it was granted, fails the codec.
+func (c *MuxCodec) readLoop() {
+	for {
+		kind, seq, n, data, err := c.readChunk()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.mtx.Lock()
+		switch kind {
+		case chunkWindow:
+			if s := c.sends[seq]; s != nil {
+				if s.window += n; s.window == muxWindow && len(s.queue) == 0 {
+					delete(c.sends, seq) // nothing granted is outstanding
+				}
+			}
+		case chunkData, chunkLast:
+			if len(c.partial[seq])+len(data) > maxFrameSize {
+				c.mtx.Unlock()
+				c.fail(fmt.Errorf("rpc: mux message too large: over %d bytes", maxFrameSize))
+				return
+			}
+			// the bytes held back are all the peer may have sent unless it ignores its window
+			if c.grants[seq]+len(data) > muxWindow {
+				c.mtx.Unlock()
+				c.fail(fmt.Errorf("rpc: mux window of seq %d exceeded", seq))
+				return
+			}
+			c.buffered += len(data)
+			if c.buffered > muxMaxBuffered && !c.progressing {
+				c.progress, c.progressing = seq, true
+				c.release(seq)
+			}
+			if c.buffered <= muxMaxBuffered || c.progressing && seq == c.progress {
+				c.control = append(c.control, windowChunk(seq, len(data)))
+			} else {
+				c.grants[seq] += len(data)
+			}
+			msg := append(c.partial[seq], data...)
+			if kind == chunkLast {
+				c.messages = append(c.messages, msg)
+				delete(c.partial, seq)
+				if c.progressing && seq == c.progress {
+					c.nextProgress()
+				}
+			} else {
+				c.partial[seq] = msg
+			}
+		}
+		c.cond.Broadcast()
+		c.mtx.Unlock()
+	}
+}
+
+// readChunk reads a chunk, n is the grant of a window chunk.
+func (c *MuxCodec) readChunk() (kind byte, seq uint64, n int, data []byte, err error) {
+	if kind, err = c.r.ReadByte(); err != nil {
+		return
+	}
+	if seq, err = binary.ReadUvarint(c.r); err != nil {
+		return
+	}
+	length, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return
+	}
+	switch kind {
+	case chunkWindow:
+		if length > muxWindow {
+			err = fmt.Errorf("rpc: mux window too large: %d bytes", length)
+		}
+		n = int(length)
+	case chunkData, chunkLast:
+		if length > maxFrameSize {
+			return kind, seq, 0, nil, fmt.Errorf("rpc: mux chunk too large: %d bytes", length)
+		}
+		data = make([]byte, length)
+		_, err = io.ReadFull(c.r, data)
+	default:
+		err = fmt.Errorf("rpc: unknown mux chunk kind %d", kind)
+	}
+	return
+}
+
+// A chunk is its kind, the uvarint Seq, the uvarint length and the payload,
+// a window chunk has no payload, its length is the grant.
+func dataChunk(kind byte, seq uint64, data []byte) []byte {
+	chunk := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(data))
+	chunk = append(chunk, kind)
+	chunk = appendUvarint(chunk, seq)
+	chunk = appendUvarint(chunk, uint64(len(data)))
+	return append(chunk, data...)
+}
+
+func windowChunk(seq uint64, n int) []byte {
+	chunk := make([]byte, 0, 1+2*binary.MaxVarintLen64)
+	chunk = append(chunk, chunkWindow)
+	chunk = appendUvarint(chunk, seq)
+	return appendUvarint(chunk, uint64(n))
+}
+
+// messageConn lets a codec encode or decode a single message in memory.
+type messageConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (conn *messageConn) Close() error { return nil }
+
+// noLock is the SendLocker of a MuxCodec.
+type noLock struct{}
+
+func (noLock) Lock()   {}
+func (noLock) Unlock() {}
+
+// SendLocker returns the lock callers hold to write a whole message to cc.
+// A MuxCodec needs none, it interleaves concurrent messages itself.
+func SendLocker(cc Codec) sync.Locker {
+	if _, ok := cc.(*MuxCodec); ok {
+		return noLock{}
+	}
+	return new(sync.Mutex)
+}
@@ -0,0 +1,58 @@
+package codec
+
+import "sync"
+
+// StreamWindow is how many messages a stream may send before the receiver
+// grants more with KindWindow, so a receiver queues at most that many
+// and a slow stream never holds up the others on its connection.
+const StreamWindow = 32
+
+// Window counts the messages a stream may still send.
+type Window struct {
+	mtx sync.Mutex
+	n   int
+	c   chan struct{} // signalled when messages are granted
+}
+
+// NewWindow returns a Window granting n messages.
+func NewWindow(n int) *Window {
+	return &Window{n: n, c: make(chan struct{}, 1)}
+}
+
+// Acquire takes one message from the window, waiting until it's granted.
+// It returns false if done is closed first.
+func (w *Window) Acquire(done <-chan struct{}) bool {
+	for {
+		w.mtx.Lock()
+		if w.n > 0 {
+			w.n--
+			more := w.n > 0
+			w.mtx.Unlock()
+			if more {
+				w.signal() // wake up the next waiter
+			}
+			return true
+		}
+		w.mtx.Unlock()
+		select {
+		case <-w.c:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// Release grants n more messages.
+func (w *Window) Release(n int) {
+	w.mtx.Lock()
+	w.n += n
+	w.mtx.Unlock()
+	w.signal()
+}
+
+func (w *Window) signal() {
+	select {
+	case w.c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,135 @@
+package metadata
+
+import (
+	"context"
+	"sync"
+)
+
+// MD is the metadata sent with a call, such as auth tokens or trace ids.
+// It is carried by codec.Header.Metadata in both directions:
+// clients send it with a request, servers send trailers back with the response.
+type MD map[string]string
+
+// Pairs returns an MD formed by the mapping of key, value ...
+// Pairs panics if len(kv) is odd.
+func Pairs(kv ...string) MD {
+	if len(kv)%2 == 1 {
+		panic("metadata: Pairs got an odd number of input pairs")
+	}
+	md := make(MD, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return md
+}
+
+// Get returns the value of key, or "" if it is not present.
+func (md MD) Get(key string) string {
+	return md[key]
+}
+
+// Copy returns a copy of md.
+func (md MD) Copy() MD {
+	out := make(MD, len(md))
+	for k, v := range md {
+		out[k] = v
+	}
+	return out
+}
+
+// Join returns the union of mds, later values overwrite earlier ones.
+func Join(mds ...MD) MD {
+	out := MD{}
+	for _, md := range mds {
+		for k, v := range md {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+type outgoingKey struct{}
+type incomingKey struct{}
+type trailerKey struct{}
+type receivedTrailerKey struct{}
+
+// NewOutgoingContext attaches md to ctx, Client.Call sends it with the request.
+func NewOutgoingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext returns a new context with the key, value pairs
+// added to the outgoing metadata of ctx.
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md, _ := FromOutgoingContext(ctx)
+	return NewOutgoingContext(ctx, Join(md, Pairs(kv...)))
+}
+
+// FromOutgoingContext returns the outgoing metadata of ctx.
+// The returned MD must not be modified.
+func FromOutgoingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(MD)
+	return md, ok
+}
+
+// NewIncomingContext attaches the metadata received with a request to ctx.
+// It is used by the server before calling a method.
+func NewIncomingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, incomingKey{}, md)
+}
+
+// FromIncomingContext returns the metadata the client sent with the request.
+// The returned MD must not be modified.
+func FromIncomingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(incomingKey{}).(MD)
+	return md, ok
+}
+
+// trailer collects the metadata a method sets while it runs.
+type trailer struct {
+	mtx sync.Mutex
+	md  MD
+}
+
+// NewServerContext is used by the server before calling a method,
+// it attaches the request metadata and room for the method's trailers.
+func NewServerContext(ctx context.Context, md MD) context.Context {
+	ctx = NewIncomingContext(ctx, md)
+	return context.WithValue(ctx, trailerKey{}, &trailer{})
+}
+
+// SetTrailer sets metadata that is sent back with the response,
+// such as server timing. It may be called several times, the values are merged.
+// It returns false if ctx is not a server method context.
+func SetTrailer(ctx context.Context, md MD) bool {
+	t, ok := ctx.Value(trailerKey{}).(*trailer)
+	if !ok {
+		return false
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.md = Join(t.md, md)
+	return true
+}
+
+// TrailerFromServerContext returns the trailers set by SetTrailer.
+func TrailerFromServerContext(ctx context.Context) MD {
+	t, ok := ctx.Value(trailerKey{}).(*trailer)
+	if !ok {
+		return nil
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.md
+}
+
+// WithTrailer asks Client.Call to store the trailers of the response in md.
+func WithTrailer(ctx context.Context, md *MD) context.Context {
+	return context.WithValue(ctx, receivedTrailerKey{}, md)
+}
+
+// ReceivedTrailer returns the destination registered by WithTrailer, or nil.
+func ReceivedTrailer(ctx context.Context) *MD {
+	md, _ := ctx.Value(receivedTrailerKey{}).(*MD)
+	return md
+}
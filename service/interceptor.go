@@ -0,0 +1,91 @@
+package server
+
+import (
+	"ToyRPC/metadata"
+	"context"
+	"errors"
+	"reflect"
+)
+
+// CallInfo describes the call an Interceptor wraps.
+type CallInfo struct {
+	ServiceMethod string // "Service.Method"
+	Service       string
+	Method        string
+	Metadata      metadata.MD // sent by the client, the same as metadata.FromIncomingContext
+	Streaming     bool        // argv or replyv is the *ServerStream of a streaming method
+}
+
+// Handler calls the next interceptor, or the method itself.
+type Handler func(ctx context.Context, argv, replyv interface{}) error
+
+// Interceptor wraps every call of a method, for auth checks, logging, metrics,
+// validation and the like. argv is the decoded argument, replyv the pointer
+// to the reply. It may return an error without calling next to short-circuit.
+// The method always gets the decoded values, so an interceptor changes
+// them in place rather than passing others to next.
+type Interceptor func(ctx context.Context, info *CallInfo, argv, replyv interface{}, next Handler) error
+
+// Use adds interceptors that wrap the calls of every service,
+// they run in the given order, before the per service ones.
+func (server *Server) Use(interceptors ...Interceptor) {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	server.interceptors = append(server.interceptors, interceptors...)
+}
+
+// UseService adds interceptors that wrap the calls of the named service only.
+func (server *Server) UseService(serviceName string, interceptors ...Interceptor) error {
+	svci, ok := server.serviceMap.Load(serviceName)
+	if !ok {
+		return errors.New("rpc server: can't find service " + serviceName)
+	}
+	svc := svci.(*Service)
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	svc.interceptors = append(svc.interceptors, interceptors...)
+	return nil
+}
+
+// invoke calls the method through the global and per service interceptors,
+// a panic of an interceptor is returned as a *PanicError like one of the method.
+func (server *Server) invoke(ctx context.Context, svc *Service, mtype *MethodType, argv, replyv reflect.Value) (err error) {
+	defer svc.recoverCall(mtype, &err)
+	server.mtx.Lock()
+	n := len(server.interceptors) + len(svc.interceptors)
+	var chain []Interceptor
+	if n > 0 {
+		chain = make([]Interceptor, 0, n)
+		chain = append(chain, server.interceptors...)
+		chain = append(chain, svc.interceptors...)
+	}
+	server.mtx.Unlock()
+	if len(chain) == 0 {
+		return svc.call(ctx, mtype, argv, replyv)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	info := &CallInfo{
+		ServiceMethod: svc.name + "." + mtype.method.Name,
+		Service:       svc.name,
+		Method:        mtype.method.Name,
+		Metadata:      md,
+		Streaming:     mtype.IsStreaming(),
+	}
+	var next func(i int) Handler
+	next = func(i int) Handler {
+		if i == len(chain) {
+			return func(ctx context.Context, _, _ interface{}) error {
+				return svc.call(ctx, mtype, argv, replyv)
+			}
+		}
+		return func(ctx context.Context, argvi, replyvi interface{}) error {
+			return chain[i](ctx, info, argvi, replyvi, next(i+1))
+		}
+	}
+	var replyvi interface{} // nil for a bidirectional stream
+	if replyv.IsValid() {
+		replyvi = replyv.Interface()
+	}
+	return next(0)(ctx, argv.Interface(), replyvi)
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"ToyRPC/metadata"
+	"ToyRPC/status"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const jsonrpcVersion = "2.0"
+
+// error codes defined by the JSON-RPC 2.0 specification
+const (
+	JSONRPCParseError     = -32700
+	JSONRPCInvalidRequest = -32600
+	JSONRPCMethodNotFound = -32601
+	JSONRPCInvalidParams  = -32602
+	JSONRPCInternalError  = -32603
+	JSONRPCServerError    = -32000 // returned by a service method
+)
+
+// jsonrpcRequest is a JSON-RPC 2.0 request or notification.
+type jsonrpcRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"` // absent for notifications
+}
+
+// JSONRPCError is the error object of a JSON-RPC 2.0 response.
+type JSONRPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *JSONRPCError) Error() string {
+	return fmt.Sprintf("jsonrpc error %d: %s", e.Code, e.Message)
+}
+
+// jsonrpcResponse is a JSON-RPC 2.0 response.
+type jsonrpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+var jsonNull = json.RawMessage("null")
+
+// isJSONRPC reports whether the first message of a connection
+// is a JSON-RPC 2.0 request (or batch) instead of a ToyRPC Option.
+func isJSONRPC(raw json.RawMessage) bool {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '[' {
+		return true
+	}
+	var probe struct {
+		Version *string `json:"jsonrpc"`
+	}
+	return json.Unmarshal(raw, &probe) == nil && probe.Version != nil
+}
+
+// serveJSONRPC serves JSON-RPC 2.0 messages on a raw connection.
+// first is the message that was already read during protocol detection.
+// Requests are handled concurrently, just like serveCodec does.
+func (server *Server) serveJSONRPC(connect io.ReadWriteCloser, first json.RawMessage, sc *serverConn) {
+	// ctx is cancelled when the connection drops
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dec := json.NewDecoder(connect)
+	buf := bufio.NewWriter(connect)
+	enc := json.NewEncoder(buf)
+	send_mtx := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+	send := func(resp interface{}) {
+		send_mtx.Lock()
+		defer send_mtx.Unlock()
+		if err := enc.Encode(resp); err != nil {
+			log.Println("rpc server: jsonrpc write response error:", err)
+		}
+		buf.Flush()
+	}
+	msg := first
+	for {
+		wg.Add(1)
+		atomic.AddInt64(&sc.inflight, 1)
+		go func(msg json.RawMessage) {
+			defer wg.Done()
+			defer atomic.AddInt64(&sc.inflight, -1)
+			if resp := server.handleJSONRPC(ctx, msg); resp != nil {
+				send(resp)
+			}
+		}(msg)
+		msg = nil
+		if err := dec.Decode(&msg); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.Is(err, net.ErrClosed) {
+				log.Println("rpc server: jsonrpc read error:", err)
+				send(&jsonrpcResponse{Version: jsonrpcVersion, ID: jsonNull,
+					Error: &JSONRPCError{Code: JSONRPCParseError, Message: err.Error()}})
+			}
+			break
+		}
+	}
+	cancel()
+	wg.Wait()
+}
+
+// serveJSONRPCHTTP serves a single JSON-RPC 2.0 message (or batch) sent by HTTP POST.
+func (server *Server) serveJSONRPCHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := server.handleJSONRPC(req.Context(), body)
+	if resp == nil { // notifications only
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// handleJSONRPC handles a single request or a batch,
+// and returns the response to send back, or nil if there is nothing to send.
+func (server *Server) handleJSONRPC(ctx context.Context, msg json.RawMessage) interface{} {
+	msg = bytes.TrimSpace(msg)
+	if len(msg) == 0 || msg[0] != '[' {
+		if resp := server.handleJSONRPCRequest(ctx, msg); resp != nil {
+			return resp
+		}
+		return nil // avoid returning a typed nil
+	}
+	var batch []json.RawMessage
+	if err := json.Unmarshal(msg, &batch); err != nil {
+		return &jsonrpcResponse{Version: jsonrpcVersion, ID: jsonNull,
+			Error: &JSONRPCError{Code: JSONRPCParseError, Message: err.Error()}}
+	}
+	if len(batch) == 0 {
+		return &jsonrpcResponse{Version: jsonrpcVersion, ID: jsonNull,
+			Error: &JSONRPCError{Code: JSONRPCInvalidRequest, Message: "empty batch"}}
+	}
+	resps := make([]*jsonrpcResponse, len(batch))
+	var wg sync.WaitGroup
+	for i := range batch {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resps[i] = server.handleJSONRPCRequest(ctx, batch[i])
+		}(i)
+	}
+	wg.Wait()
+	results := make([]*jsonrpcResponse, 0, len(resps))
+	for _, resp := range resps {
+		if resp != nil {
+			results = append(results, resp)
+		}
+	}
+	if len(results) == 0 { // a batch of notifications gets no response
+		return nil
+	}
+	return results
+}
+
+// handleJSONRPCRequest calls the method named by a single request.
+// It returns nil for notifications. A request that isn't valid is answered
+// even without an id, with a null id then.
+func (server *Server) handleJSONRPCRequest(ctx context.Context, msg json.RawMessage) *jsonrpcResponse {
+	var req jsonrpcRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return &jsonrpcResponse{Version: jsonrpcVersion, ID: jsonNull,
+			Error: &JSONRPCError{Code: JSONRPCInvalidRequest, Message: err.Error()}}
+	}
+	if req.Version != jsonrpcVersion || req.Method == "" || !validJSONRPCID(req.ID) {
+		id := req.ID
+		if id == nil || !validJSONRPCID(id) {
+			id = jsonNull
+		}
+		return &jsonrpcResponse{Version: jsonrpcVersion, ID: id,
+			Error: &JSONRPCError{Code: JSONRPCInvalidRequest, Message: "rpc server: invalid jsonrpc request"}}
+	}
+	reply, rpcErr := server.callJSONRPC(ctx, &req)
+	if req.ID == nil { // notification
+		return nil
+	}
+	resp := &jsonrpcResponse{Version: jsonrpcVersion, ID: req.ID}
+	if rpcErr != nil {
+		resp.Error = rpcErr
+	} else {
+		resp.Result = reply
+	}
+	return resp
+}
+
+// validJSONRPCID reports whether id is absent, a string, a number or null.
+func validJSONRPCID(id json.RawMessage) bool {
+	id = bytes.TrimSpace(id)
+	if len(id) == 0 {
+		return true
+	}
+	switch id[0] {
+	case '{', '[', 't', 'f':
+		return false
+	}
+	return true
+}
+
+// callJSONRPC calls the method of req like handleRequest does,
+// within the handle timeout set by WithJSONRPCHandleTimeout.
+func (server *Server) callJSONRPC(ctx context.Context, req *jsonrpcRequest) (interface{}, *JSONRPCError) {
+	svc, mtype, err := server.findService(req.Method)
+	if err != nil {
+		rpcErr := server.jsonrpcError(err)
+		if status.CodeOf(err) == status.NotFound {
+			rpcErr.Code = JSONRPCMethodNotFound
+		}
+		return nil, rpcErr
+	}
+	if mtype.IsStreaming() {
+		return nil, &JSONRPCError{Code: JSONRPCMethodNotFound, Message: "rpc server: streaming method " + req.Method + " can't be called over JSON-RPC"}
+	}
+	argv := mtype.newArgv()
+	replyv := mtype.newReplyv()
+	if err := decodeJSONRPCParams(req.Params, argv); err != nil {
+		return nil, &JSONRPCError{Code: JSONRPCInvalidParams, Message: err.Error()}
+	}
+	timeout := server.jsonrpcTimeout
+	var cancel context.CancelFunc
+	if timeout == 0 {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	ctx = metadata.NewServerContext(ctx, nil)
+	called := make(chan error, 1) // buffered, so a discarded method can still return
+	go func() {
+		called <- server.invoke(ctx, svc, mtype, argv, replyv)
+	}()
+	select {
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded && timeout > 0 {
+			err = status.Errorf(status.DeadlineExceeded, "rpc server: request handle timeout: expect within %s", timeout)
+		} else {
+			err = ctx.Err() // the HTTP request or the connection is gone
+		}
+		return nil, server.jsonrpcError(err)
+	case err := <-called:
+		if err != nil {
+			return nil, server.jsonrpcError(err)
+		}
+	}
+	return replyv.Interface(), nil
+}
+
+// jsonrpcErrorData is the data of the errors returned by a method.
+type jsonrpcErrorData struct {
+	Status  string            `json:"status"` // the name of the status.Code
+	Details map[string]string `json:"details,omitempty"`
+	Stack   string            `json:"stack,omitempty"` // of a panicking method, see WithPanicStack
+}
+
+// jsonrpcError maps err to a JSON-RPC error. InvalidArgument and Internal
+// have codes of their own, the other errors are server errors,
+// their status code is told by the data.
+func (server *Server) jsonrpcError(err error) *JSONRPCError {
+	st, _ := status.FromError(err)
+	data := &jsonrpcErrorData{Status: st.Code.String(), Details: st.Details}
+	rpcErr := &JSONRPCError{Code: JSONRPCServerError, Message: err.Error(), Data: data}
+	var pe *PanicError
+	if errors.As(err, &pe) {
+		st = status.New(status.Internal, pe.Error())
+		data.Status = st.Code.String()
+		if server.panicStack {
+			data.Stack = string(pe.Stack)
+		}
+	}
+	switch st.Code {
+	case status.InvalidArgument:
+		rpcErr.Code = JSONRPCInvalidParams
+	case status.Internal:
+		rpcErr.Code = JSONRPCInternalError
+	}
+	return rpcErr
+}
+
+// WithJSONRPCHandleTimeout sets the handle timeout of JSON-RPC requests,
+// which don't send an Option. The default 0 means no timeout.
+func WithJSONRPCHandleTimeout(timeout time.Duration) ServerOption {
+	return func(server *Server) {
+		server.jsonrpcTimeout = timeout
+	}
+}
+
+// decodeJSONRPCParams decodes params into argv.
+// ToyRPC methods take a single argument, so by-position params must hold
+// exactly one element, while by-name params are decoded into argv directly.
+func decodeJSONRPCParams(params json.RawMessage, argv reflect.Value) error {
+	argvi := argv.Interface()
+	if argv.Type().Kind() != reflect.Ptr {
+		argvi = argv.Addr().Interface()
+	}
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 {
+		return nil
+	}
+	if params[0] == '[' {
+		var positional []json.RawMessage
+		if err := json.Unmarshal(params, &positional); err != nil {
+			return err
+		}
+		if len(positional) != 1 {
+			// the argument itself may be a slice
+			return unmarshalNumber(params, argvi)
+		}
+		params = positional[0]
+	}
+	return unmarshalNumber(params, argvi)
+}
+
+// unmarshalNumber is json.Unmarshal, but keeps numbers as json.Number
+// when decoding into interface{}, the same way JsonCodec does.
+func unmarshalNumber(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
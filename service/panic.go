@@ -0,0 +1,52 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// ErrPanic is the kind of the errors reported for a method that panicked,
+// errors.Is(err, ErrPanic) holds for them on both the server and the client.
+var ErrPanic = errors.New("rpc server: method panicked")
+
+// PanicError is returned by a method call that panicked instead of returning.
+type PanicError struct {
+	ServiceMethod string
+	Value         interface{} // the value passed to panic
+	Stack         []byte      // the stack of the panicking goroutine
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", ErrPanic, e.ServiceMethod, e.Value)
+}
+
+func (e *PanicError) Unwrap() error {
+	return ErrPanic
+}
+
+// ServerOption configures a Server, see NewServer.
+type ServerOption func(*Server)
+
+// WithPanicStack makes the server send the stack trace of a panicking method
+// to the client along with the error. It's off by default, as the stack
+// tells the client about the server's internals.
+func WithPanicStack(send bool) ServerOption {
+	return func(server *Server) {
+		server.panicStack = send
+	}
+}
+
+// recoverCall turns a panic of the method or its interceptors into a *PanicError
+// stored in err. It must be deferred directly by Service.call or Server.invoke.
+func (s *Service) recoverCall(m *MethodType, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	m.countPanic()
+	pe := &PanicError{ServiceMethod: s.name + "." + m.method.Name, Value: v, Stack: debug.Stack()}
+	log.Printf("%v\n%s", pe, pe.Stack)
+	*err = pe
+}
@@ -11,9 +11,12 @@ package server
 
 import (
 	"ToyRPC/codec"
+	"ToyRPC/metadata"
+	"ToyRPC/status"
+	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"net"
@@ -21,6 +24,7 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -36,6 +40,13 @@ type Option struct {
 	CodecType     string        // client may choose different Codec to encode body
 	ConnTimeOut   time.Duration // connect timeout
 	HandleTimeOut time.Duration // handle timeout
+	// Compress names the codec.Compressor for every frame, codec.CompressNone disables it
+	Compress          string
+	CompressThreshold int // frames smaller than it are sent uncompressed, 0 means codec.DefaultCompressThreshold
+	// Multiplex splits messages into chunks of at most ChunkSize bytes,
+	// so large messages don't hold up the others on the connection, see codec.NewMuxCodecFunc
+	Multiplex bool
+	ChunkSize int // 0 means codec.DefaultChunkSize
 }
 
 var DefaultOption = &Option{
@@ -47,11 +58,25 @@ var DefaultOption = &Option{
 // Server represents an RPC Server.
 type Server struct {
 	serviceMap sync.Map
+	mtx        sync.Mutex // protect following
+	listeners  map[net.Listener]struct{}
+	conns      map[*serverConn]struct{}
+	inShutdown bool
+	// interceptors wrap the calls of every service
+	interceptors []Interceptor
+	// panicStack sends the stack trace of a panicking method to the client
+	panicStack bool
+	// jsonrpcTimeout is the handle timeout of JSON-RPC requests
+	jsonrpcTimeout time.Duration
 }
 
-// NewServer returns a new Server.
-func NewServer() *Server {
-	return &Server{}
+// NewServer returns a new Server configured by opts.
+func NewServer(opts ...ServerOption) *Server {
+	server := &Server{}
+	for _, opt := range opts {
+		opt(server)
+	}
+	return server
 }
 
 // DefaultServer is the default instance of *Server.
@@ -61,11 +86,34 @@ var DefaultServer = NewServer()
 // serverConnect blocks, serving the connection until the client hangs up.
 func (server *Server) serverConnect(connect io.ReadWriteCloser) {
 	defer connect.Close()
+	sc := server.trackConn(connect)
+	if sc == nil {
+		return // the server is shutting down
+	}
+	defer server.untrackConn(sc)
 	var opt Option
-	if err := json.NewDecoder(connect).Decode(&opt); err != nil {
+	var raw json.RawMessage
+	dec := json.NewDecoder(connect)
+	if err := dec.Decode(&raw); err != nil {
 		log.Println("rpc server: options error: ", err)
 		return
 	}
+	// the json decoder may have read ahead past the options,
+	// so the codec must see those buffered bytes first
+	buffered := io.MultiReader(dec.Buffered(), connect)
+	if isJSONRPC(raw) {
+		server.serveJSONRPC(&bufferedConn{Reader: buffered, ReadWriteCloser: connect}, raw, sc)
+		return
+	}
+	if err := json.Unmarshal(raw, &opt); err != nil {
+		log.Println("rpc server: options error: ", err)
+		return
+	}
+	r := bufio.NewReader(buffered)
+	if b, err := r.Peek(1); err == nil && b[0] == '\n' {
+		_, _ = r.Discard(1) // json.Encoder terminates the options with a newline
+	}
+	connect = &bufferedConn{Reader: r, ReadWriteCloser: connect}
 	if opt.MagicNumber != MagicNumber {
 		log.Printf("rpc server: invalid magic number %x", opt.MagicNumber)
 		return
@@ -75,28 +123,80 @@ func (server *Server) serverConnect(connect io.ReadWriteCloser) {
 		log.Printf("rpc server: invalid codec type %s", opt.CodecType)
 		return
 	}
-	server.serveCodec(f(connect), &opt)
+	f, err := codec.NewCompressCodecFunc(f, opt.Compress, opt.CompressThreshold)
+	if err != nil {
+		log.Println("rpc server: invalid compression:", err)
+		return
+	}
+	if opt.Multiplex {
+		f = codec.NewMuxCodecFunc(f, opt.ChunkSize)
+	}
+	server.serveCodec(f(connect), &opt, sc)
+}
+
+// bufferedConn reads from Reader but writes to and closes the underlying connection.
+type bufferedConn struct {
+	io.Reader
+	io.ReadWriteCloser
 }
 
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.Reader.Read(p) }
+
 // invalidRequest is a placeholder for response argv when error occurs
 var invalidRequest = struct{}{}
 
-func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
-	send_mtx := new(sync.Mutex) // make sure to send a complete response
-	wg := new(sync.WaitGroup)   // wait until all request are handled
+func (server *Server) serveCodec(cc codec.Codec, opt *Option, sc *serverConn) {
+	send_mtx := codec.SendLocker(cc) // make sure to send a complete response
+	wg := new(sync.WaitGroup)        // wait until all request are handled
+	sc.setGoAway(server.goAwayFunc(cc, send_mtx))
+	// ctx is cancelled when the connection drops, so are the requests' contexts
+	ctx, cancel := context.WithCancel(context.Background())
+	cancels := newRequestCancels() // cancel funcs of in-flight requests
+	streams := newServerStreams()  // streams of in-flight requests
 	for {
-		req, err := server.readRequest(cc)
+		h, err := server.readRequestHeader(cc)
 		if err != nil {
-			if req == nil {
-				break // it's not possible to recover, so close the connection
-			}
-			req.h.Error = err.Error()
+			break // it's not possible to recover, so close the connection
+		}
+		// the request counts as in flight from its header on,
+		// so Shutdown doesn't close the connection while reading its body
+		atomic.AddInt64(&sc.inflight, 1)
+		req, err := server.readRequest(cc, h, opt.CodecType)
+		if err != nil {
+			server.setError(req.h, err)
+			req.h.Metadata = nil // don't echo the request metadata
 			server.sendResponse(cc, req.h, invalidRequest, send_mtx)
+			atomic.AddInt64(&sc.inflight, -1)
 			continue
 		}
+		switch req.h.Kind {
+		case codec.KindCancel:
+			cancels.cancel(req.h.Seq)
+			atomic.AddInt64(&sc.inflight, -1)
+			continue
+		case codec.KindStream, codec.KindStreamEnd, codec.KindWindow:
+			if err := streams.receive(cc, req.h); err != nil {
+				log.Println("rpc server: read stream message err:", err)
+			}
+			atomic.AddInt64(&sc.inflight, -1)
+			continue
+		}
+		// register before handling, so a cancel or stream message read next finds it
+		reqCtx, reqCancel := context.WithCancel(ctx)
+		cancels.add(req.h.Seq, reqCancel)
+		if req.mtype.IsStreaming() {
+			req.stream = newServerStream(cc, req.h, send_mtx)
+			streams.add(req.h.Seq, req.stream)
+		}
 		wg.Add(1)
-		go server.handleRequest(cc, req, send_mtx, wg, opt.HandleTimeOut)
+		go func(req *request) {
+			defer atomic.AddInt64(&sc.inflight, -1)
+			defer streams.remove(req.h.Seq)
+			defer cancels.cancel(req.h.Seq)
+			server.handleRequest(reqCtx, cc, req, send_mtx, wg, opt.HandleTimeOut)
+		}(req)
 	}
+	cancel()
 	wg.Wait()
 	cc.Close()
 }
@@ -108,10 +208,14 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	}()
+	if req.Method == "POST" {
+		server.serveJSONRPCHTTP(w, req)
+		return
+	}
 	if req.Method != "CONNECT" {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusMethodNotAllowed)
-		io.WriteString(w, "405 must CONNECT\n")
+		io.WriteString(w, "405 must CONNECT or POST\n")
 		return
 	}
 	conn, _, err := w.(http.Hijacker).Hijack()
@@ -133,19 +237,47 @@ func HandleHTTP() {
 	DefaultServer.HandleHTTP()
 }
 
+// requestCancels tracks the cancel funcs of the in-flight requests of a connection by Seq.
+type requestCancels struct {
+	mtx sync.Mutex
+	m   map[uint64]context.CancelFunc
+}
+
+func newRequestCancels() *requestCancels {
+	return &requestCancels{m: make(map[uint64]context.CancelFunc)}
+}
+
+func (rc *requestCancels) add(seq uint64, cancel context.CancelFunc) {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	rc.m[seq] = cancel
+}
+
+// cancel cancels the request and forgets it, unknown seqs are ignored
+// since the request may have finished while the cancel message was on its way.
+func (rc *requestCancels) cancel(seq uint64) {
+	rc.mtx.Lock()
+	cancel := rc.m[seq]
+	delete(rc.m, seq)
+	rc.mtx.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
 // request stores all information of a call
 type request struct {
 	h            *codec.Header // header of request
 	argv, replyv reflect.Value // argv and replyv of request
 	mtype        *MethodType   // methodType of request
 	svc          *Service      // service of request
-
+	stream       *ServerStream // stream of a streaming request
 }
 
 func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 	var h codec.Header
 	if err := cc.ReadHeader(&h); err != nil {
-		if err != io.EOF && err != io.ErrUnexpectedEOF {
+		if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.Is(err, net.ErrClosed) {
 			log.Println("rpc server: read header error:", err)
 		}
 		return nil, err
@@ -153,12 +285,16 @@ func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 	return &h, nil
 }
 
-func (server *Server) readRequest(cc codec.Codec) (*request, error) {
-	h, err := server.readRequestHeader(cc)
-	if err != nil {
-		return nil, err
-	}
+// readRequest reads the body of the request with header h, sent with codecType.
+func (server *Server) readRequest(cc codec.Codec, h *codec.Header, codecType string) (*request, error) {
+	var err error
 	req := &request{h: h}
+	if h.Kind == codec.KindStream {
+		return req, nil // the body is read by the stream
+	}
+	if h.Kind != codec.KindCall {
+		return req, cc.ReadBody(nil) // control messages have no meaningful body
+	}
 	// req.argv = reflect.New(reflect.TypeOf(""))
 	// if err = cc.ReadBody(req.argv.Interface()); err != nil {
 	// 	log.Println("rpc server: read argv err:", err)
@@ -166,11 +302,23 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	req.svc, req.mtype, err = server.findService(h.ServiceMethod)
 	if err != nil {
 		log.Println("rpc server: read svc, method type err:", err)
+		_ = cc.ReadBody(nil) // drain the body so the next header stays in sync
 		return req, err
 	}
+	if codecType == codec.BinaryType && req.mtype.binaryErr != nil {
+		_ = cc.ReadBody(nil)
+		return req, status.Errorf(status.Unimplemented, "rpc server: %s can't be called with the binary codec: %v",
+			h.ServiceMethod, req.mtype.binaryErr)
+	}
 
+	if !req.mtype.serverStreaming {
+		req.replyv = req.mtype.newReplyv()
+	}
+	if req.mtype.clientStreaming {
+		// the args come on the stream, which is created by serveCodec
+		return req, cc.ReadBody(nil)
+	}
 	req.argv = req.mtype.newArgv()
-	req.replyv = req.mtype.newReplyv()
 
 	argvi := req.argv.Interface()
 	if req.argv.Type().Kind() != reflect.Ptr {
@@ -179,62 +327,136 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 
 	if err = cc.ReadBody(argvi); err != nil {
 		log.Println("rpc server: read argv err:", err)
-		return req, err
+		return req, status.New(status.InvalidArgument, "rpc server: read argv err: "+err.Error())
 	}
 
 	return req, nil
 }
 
-func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interface{}, send_mtx *sync.Mutex) {
+// setError stores err in h, along with the status code and details it maps to.
+func (server *Server) setError(h *codec.Header, err error) {
+	st := server.toStatus(err)
+	h.Error = st.Message
+	h.Code = uint32(st.Code)
+	h.Details = st.Details
+}
+
+// toStatus returns the status sent to the client for err. A panic is an
+// Internal error carrying the stack if the server is asked to, an error
+// without a code is Unknown.
+func (server *Server) toStatus(err error) *status.Error {
+	var pe *PanicError
+	if errors.As(err, &pe) {
+		msg := pe.Error()
+		if server.panicStack {
+			msg += "\n" + string(pe.Stack)
+		}
+		return status.New(status.Internal, msg)
+	}
+	st, _ := status.FromError(err)
+	if msg := err.Error(); st.Message != msg {
+		// keep the context of a wrapped status error
+		st = &status.Error{Code: st.Code, Message: msg, Details: st.Details}
+	}
+	return st
+}
+
+func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interface{}, send_mtx sync.Locker) {
 	send_mtx.Lock()
 	defer send_mtx.Unlock()
 	if err := cc.Write(h, body); err != nil {
 		log.Println("rpc server: write response error:", err)
+		if errors.Is(err, codec.ErrFrameTooLarge) && body != invalidRequest {
+			// nothing was sent, the client gets the error instead
+			server.setError(h, status.Errorf(status.ResourceExhausted, "rpc server: reply of %s not sent: %v", h.ServiceMethod, err))
+			h.Metadata = nil
+			_ = cc.Write(h, invalidRequest)
+		}
 	}
 }
 
-func (server *Server) handleRequest(cc codec.Codec, req *request, send_mtx *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
+// handleRequest calls the method of req and sends its response.
+// The method's context is cancelled when the client cancels the request,
+// the connection drops or the timeout fires, in the latter case a timeout error is sent
+// without waiting for the method, whose result is then discarded.
+func (server *Server) handleRequest(ctx context.Context, cc codec.Codec, req *request, send_mtx sync.Locker, wg *sync.WaitGroup, timeout time.Duration) {
 	defer wg.Done()
-	//log.Println(req.h, req.argv.Elem())
-	called := make(chan struct{})
-	sent := make(chan struct{})
+	// the caller's deadline applies on top of the connection's handle timeout
+	if req.h.Timeout > 0 && (timeout == 0 || req.h.Timeout < timeout) {
+		timeout = req.h.Timeout
+	}
+	req.h.Timeout = 0
+	var cancel context.CancelFunc
+	if timeout == 0 {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	ctx = metadata.NewServerContext(ctx, req.h.Metadata)
+	stream := req.stream
+	if stream != nil {
+		stream.ctx = ctx
+		if req.mtype.clientStreaming {
+			req.argv = reflect.ValueOf(stream)
+		}
+		if req.mtype.serverStreaming {
+			req.replyv = reflect.Value{}
+			if !req.mtype.clientStreaming {
+				req.replyv = reflect.ValueOf(stream)
+			}
+			req.h.Kind = codec.KindStreamEnd // the response below ends the stream
+		}
+	}
+	called := make(chan error, 1) // buffered, so a discarded method can still return
 	go func() {
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
-		called <- struct{}{}
+		called <- server.invoke(ctx, req.svc, req.mtype, req.argv, req.replyv)
+	}()
+
+	select {
+	case <-ctx.Done():
+		if stream != nil {
+			stream.close()
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			server.setError(req.h, status.Errorf(status.DeadlineExceeded, "rpc server: request handle timeout: expect within %s", timeout))
+			req.h.Metadata = nil
+			server.sendResponse(cc, req.h, invalidRequest, send_mtx)
+		}
+		// otherwise the client cancelled the request or the connection is gone,
+		// nobody waits for the response
+	case err := <-called:
+		if stream != nil {
+			stream.close()
+		}
+		req.h.Metadata = metadata.TrailerFromServerContext(ctx)
 		if err != nil {
-			req.h.Error = err.Error()
+			server.setError(req.h, err)
+			server.sendResponse(cc, req.h, invalidRequest, send_mtx)
+			return
+		}
+		if req.mtype.serverStreaming {
 			server.sendResponse(cc, req.h, invalidRequest, send_mtx)
-			sent <- struct{}{}
 			return
 		}
-		//req.replyv = reflect.ValueOf(fmt.Sprintf("ToyRPC respones %d", req.h.Seq))
 		server.sendResponse(cc, req.h, req.replyv.Interface(), send_mtx)
-		sent <- struct{}{}
-	}()
-
-	if timeout == 0 {
-		<-called
-		<-sent
-		return
-	}
-
-	select {
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, send_mtx)
-	case <-called:
-		<-sent
 	}
-
 }
 
 // Accept accepts connections on the listener and serves requests
 // for each incoming connection.
 func (server *Server) Accept(lis net.Listener) {
+	if !server.trackListener(lis, true) {
+		_ = lis.Close()
+		return
+	}
+	defer server.trackListener(lis, false)
 	for {
 		connect, err := lis.Accept()
 		if err != nil {
-			log.Println("rpc server: accept error:", err)
+			if !server.shuttingDown() {
+				log.Println("rpc server: accept error:", err)
+			}
 			return
 		}
 		go server.serverConnect(connect)
@@ -260,19 +482,19 @@ func Register(rcvr interface{}) error { return DefaultServer.Register(rcvr) }
 func (server *Server) findService(serviceMethod string) (svc *Service, mtype *MethodType, err error) {
 	dot := strings.LastIndex(serviceMethod, ".")
 	if dot < 0 {
-		err = errors.New("rpc server: service/method request ill-formed: " + serviceMethod)
+		err = status.New(status.InvalidArgument, "rpc server: service/method request ill-formed: "+serviceMethod)
 		return
 	}
 	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
 	svci, ok := server.serviceMap.Load(serviceName)
 	if !ok {
-		err = errors.New("rpc server: can't find service " + serviceName)
+		err = status.New(status.NotFound, "rpc server: can't find service "+serviceName)
 		return
 	}
 	svc = svci.(*Service)
 	mtype = svc.method[methodName]
 	if mtype == nil {
-		err = errors.New("rpc server: can't find method " + methodName)
+		err = status.New(status.NotFound, "rpc server: can't find method "+methodName)
 	}
 	return
 }
@@ -10,6 +10,8 @@
 package server
 
 import (
+	"ToyRPC/codec"
+	"context"
 	"go/ast"
 	"log"
 	"reflect"
@@ -21,6 +23,8 @@ type Service struct {
 	typ    reflect.Type
 	rcvr   reflect.Value
 	method map[string]*MethodType
+	// interceptors wrap the calls of this service only, protected by Server.mtx
+	interceptors []Interceptor
 }
 
 func NewService(rcvr interface{}) *Service {
@@ -32,6 +36,11 @@ func NewService(rcvr interface{}) *Service {
 		log.Fatalf("rpc server: %s is not a valid service name", s.name)
 	}
 	s.method = buildMethods4Service(s.typ)
+	for name, m := range s.method {
+		if m.binaryErr != nil {
+			log.Printf("rpc server: %s.%s can't be called with the binary codec: %v", s.name, name, m.binaryErr)
+		}
+	}
 	return s
 }
 
@@ -45,26 +54,61 @@ func buildMethods4Service(typ reflect.Type) map[string]*MethodType {
 		if method.PkgPath != "" {
 			continue // method must be exported
 		}
-		if mtype.NumIn() != 3 || mtype.NumOut() != 1 {
+		// func (T) Method(args, reply) error, or
+		// func (T) Method(ctx context.Context, args, reply) error,
+		// args or reply may be a *ServerStream for a streaming method,
+		// a bidirectional one takes the stream only
+		withContext := mtype.NumIn() == 4 && mtype.In(1) == typeOfContext
+		bidi := mtype.In(mtype.NumIn()-1) == typeOfServerStream &&
+			(mtype.NumIn() == 2 || mtype.NumIn() == 3 && mtype.In(1) == typeOfContext)
+		if bidi {
+			withContext = mtype.NumIn() == 3
+		}
+		if (mtype.NumIn() != 3 && !withContext) || mtype.NumOut() != 1 {
 			continue
 		}
-		argType := mtype.In(1)
-		replyType := mtype.In(2)
+		argType, replyType := typeOfServerStream, typeOfServerStream
+		if !bidi {
+			argType = mtype.In(mtype.NumIn() - 2)
+			replyType = mtype.In(mtype.NumIn() - 1)
+		}
 		if !isExportedOrBuiltinType(replyType) && !isExportedOrBuiltinType(argType) {
 			continue
 		}
 		if mtype.NumOut() != 1 {
 			continue
 		}
-		methods[mname] = &MethodType{method: method, ArgType: argType, ReplyType: replyType}
+		clientStreaming := argType == typeOfServerStream
+		serverStreaming := replyType == typeOfServerStream
+		// derive the binary codec schema up front, an unsupported type
+		// only matters to clients that pick the binary codec
+		var binaryErr error
+		if !clientStreaming {
+			binaryErr = codec.CompileSchema(argType)
+		}
+		if !serverStreaming && binaryErr == nil {
+			binaryErr = codec.CompileSchema(replyType)
+		}
+		methods[mname] = &MethodType{method: method, ArgType: argType, ReplyType: replyType, withContext: withContext,
+			clientStreaming: clientStreaming, serverStreaming: serverStreaming, binaryErr: binaryErr}
 	}
 	return methods
 }
 
-func (s *Service) call(m *MethodType, argv, replyv reflect.Value) error {
+// call calls the method, a panic of the method is returned as a *PanicError.
+func (s *Service) call(ctx context.Context, m *MethodType, argv, replyv reflect.Value) (err error) {
 	atomic.AddUint64(&m.numsCall, 1)
+	defer s.recoverCall(m, &err)
 	f := m.method.Func
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	in := []reflect.Value{s.rcvr}
+	if m.withContext {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	in = append(in, argv)
+	if replyv.IsValid() {
+		in = append(in, replyv) // a bidirectional stream is passed as argv only
+	}
+	returnValues := f.Call(in)
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
@@ -76,12 +120,35 @@ type MethodType struct {
 	ArgType   reflect.Type
 	ReplyType reflect.Type
 	numsCall  uint64
+	numsPanic uint64
+	// withContext is set for methods taking a context.Context first
+	withContext bool
+	// clientStreaming is set for methods receiving their args on a *ServerStream,
+	// serverStreaming for methods sending their replies on it, both for bidirectional ones
+	clientStreaming bool
+	serverStreaming bool
+	// binaryErr tells why the binary codec can't encode the args or reply, if it can't
+	binaryErr error
+}
+
+// IsStreaming reports whether the method takes a *ServerStream.
+func (m *MethodType) IsStreaming() bool {
+	return m.clientStreaming || m.serverStreaming
 }
 
 func (m *MethodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numsCall)
 }
 
+// NumPanics returns how many calls of the method panicked.
+func (m *MethodType) NumPanics() uint64 {
+	return atomic.LoadUint64(&m.numsPanic)
+}
+
+func (m *MethodType) countPanic() {
+	atomic.AddUint64(&m.numsPanic, 1)
+}
+
 func (m *MethodType) newArgv() reflect.Value {
 	var argv reflect.Value
 	if m.ArgType.Kind() == reflect.Ptr {
@@ -103,6 +170,8 @@ func (m *MethodType) newReplyv() reflect.Value {
 	return replyv
 }
 
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
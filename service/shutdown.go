@@ -0,0 +1,198 @@
+package server
+
+import (
+	"ToyRPC/codec"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by Shutdown and Close when they're called twice.
+var ErrServerClosed = errors.New("rpc server: server closed")
+
+// shutdownPollInterval is how often Shutdown checks for drained connections.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// goAwayGrace is how long Shutdown leaves an idle connection open after the
+// goaway message. A request may be on its way while the message is, and the
+// client acknowledges by closing the connection once its calls are answered,
+// so only connections whose client didn't do so within goAwayGrace are closed.
+const goAwayGrace = time.Second
+
+// serverConn is a connection tracked for Shutdown and Close.
+type serverConn struct {
+	rwc      io.Closer
+	inflight int64 // atomic, number of requests being handled
+
+	mtx      sync.Mutex // protect following
+	goAway   func()     // tells the client to stop sending, set by serveCodec
+	goneOff  bool       // Shutdown has started for this connection
+	goAwayAt time.Time  // when Shutdown started for this connection
+}
+
+// setGoAway installs f to notify the client,
+// f runs right away if the server is already shutting down.
+func (sc *serverConn) setGoAway(f func()) {
+	sc.mtx.Lock()
+	sc.goAway = f
+	goneOff := sc.goneOff
+	sc.mtx.Unlock()
+	if goneOff {
+		f()
+	}
+}
+
+func (sc *serverConn) sendGoAway() {
+	sc.mtx.Lock()
+	f := sc.goAway
+	sc.goneOff = true
+	sc.goAwayAt = time.Now()
+	sc.mtx.Unlock()
+	if f != nil {
+		f()
+	}
+}
+
+// graceOver reports whether goAwayGrace has passed since the goaway message.
+func (sc *serverConn) graceOver() bool {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	return sc.goneOff && time.Since(sc.goAwayAt) >= goAwayGrace
+}
+
+// goAwayFunc returns a function sending a goaway message on cc.
+func (server *Server) goAwayFunc(cc codec.Codec, send_mtx sync.Locker) func() {
+	return func() {
+		server.sendResponse(cc, &codec.Header{Kind: codec.KindGoAway}, invalidRequest, send_mtx)
+	}
+}
+
+// trackListener adds or removes lis, it returns false if the server is shut down.
+func (server *Server) trackListener(lis net.Listener, add bool) bool {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	if !add {
+		delete(server.listeners, lis)
+		return true
+	}
+	if server.inShutdown {
+		return false
+	}
+	if server.listeners == nil {
+		server.listeners = make(map[net.Listener]struct{})
+	}
+	server.listeners[lis] = struct{}{}
+	return true
+}
+
+// trackConn starts tracking rwc, it returns nil if the server is shut down.
+func (server *Server) trackConn(rwc io.Closer) *serverConn {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	if server.inShutdown {
+		return nil
+	}
+	if server.conns == nil {
+		server.conns = make(map[*serverConn]struct{})
+	}
+	sc := &serverConn{rwc: rwc}
+	server.conns[sc] = struct{}{}
+	return sc
+}
+
+func (server *Server) untrackConn(sc *serverConn) {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	delete(server.conns, sc)
+}
+
+// startShutdown stops accepting connections and
+// returns the connections being served.
+func (server *Server) startShutdown() ([]*serverConn, error) {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	if server.inShutdown {
+		return nil, ErrServerClosed
+	}
+	server.inShutdown = true
+	var err error
+	for lis := range server.listeners {
+		if e := lis.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(server.listeners, lis)
+	}
+	conns := make([]*serverConn, 0, len(server.conns))
+	for sc := range server.conns {
+		conns = append(conns, sc)
+	}
+	return conns, err
+}
+
+func (server *Server) shuttingDown() bool {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	return server.inShutdown
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting connections,
+// tells connected clients to stop sending new calls and waits for the
+// in-flight calls to be answered. A connection is closed once its client
+// hangs up, or once it's idle and goAwayGrace has passed.
+// If ctx is done first, the remaining connections are closed
+// and ctx.Err() is returned.
+func (server *Server) Shutdown(ctx context.Context) error {
+	conns, err := server.startShutdown()
+	if err == ErrServerClosed {
+		return err
+	}
+	for _, sc := range conns {
+		sc.sendGoAway()
+	}
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if server.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			server.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdleConns closes the connections without in-flight calls whose
+// client had goAwayGrace to hang up, it reports whether every connection is gone.
+func (server *Server) closeIdleConns() bool {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	for sc := range server.conns {
+		if atomic.LoadInt64(&sc.inflight) == 0 && sc.graceOver() {
+			_ = sc.rwc.Close()
+		}
+	}
+	return len(server.conns) == 0
+}
+
+func (server *Server) closeConns() {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	for sc := range server.conns {
+		_ = sc.rwc.Close()
+	}
+}
+
+// Close immediately closes all listeners and connections,
+// in-flight calls are not answered. Use Shutdown to drain them.
+func (server *Server) Close() error {
+	_, err := server.startShutdown()
+	server.closeConns()
+	return err
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"ToyRPC/codec"
+	"ToyRPC/status"
+	"context"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+)
+
+// ServerStream is the server side of a streaming call. A method is
+// server streaming, client streaming or bidirectional when it's declared as
+//
+//	func (t *T) MethodName(argType T1, stream *ServerStream) error
+//	func (t *T) MethodName(stream *ServerStream, replyType *T2) error
+//	func (t *T) MethodName(stream *ServerStream) error
+//
+// optionally taking a context.Context first. Every message carries the Seq
+// of the request, so streams share the connection with other calls.
+// Returning from the method ends the stream, the client gets the error and
+// the trailers, and the reply of a client streaming method.
+//
+// Both directions are flow controlled: Send waits while the client has
+// codec.StreamWindow messages it hasn't read yet, and the client may only
+// send once the method has called Recv.
+type ServerStream struct {
+	ctx        context.Context // set by handleRequest before the method runs
+	cc         codec.Codec
+	h          codec.Header // ServiceMethod and Seq of the request
+	send_mtx   sync.Locker  // shared with the connection
+	sendWindow *codec.Window
+
+	closeMtx sync.Mutex // protect following
+	closed   bool       // the stream has ended, Send fails
+
+	mtx      sync.Mutex // protect following
+	recvType reflect.Type
+	queue    []reflect.Value // received messages not taken by Recv yet
+	recvErr  error           // io.EOF once the client has closed its side
+	consumed int             // messages taken by Recv since the last window update
+	notify   chan struct{}   // signalled when a message is queued or recvErr is set
+}
+
+var typeOfServerStream = reflect.TypeOf((*ServerStream)(nil))
+
+func newServerStream(cc codec.Codec, h *codec.Header, send_mtx sync.Locker) *ServerStream {
+	return &ServerStream{
+		cc:         cc,
+		h:          codec.Header{ServiceMethod: h.ServiceMethod, Seq: h.Seq},
+		send_mtx:   send_mtx,
+		sendWindow: codec.NewWindow(codec.StreamWindow),
+		notify:     make(chan struct{}, 1),
+	}
+}
+
+// Context returns the context of the call, it's done when the client
+// cancels the stream, the timeout fires or the connection drops.
+func (s *ServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// Send sends reply to the client. It fails once the context is done,
+// the method should return then.
+func (s *ServerStream) Send(reply interface{}) error {
+	if !s.sendWindow.Acquire(s.ctx.Done()) {
+		return s.ctx.Err()
+	}
+	s.closeMtx.Lock()
+	defer s.closeMtx.Unlock()
+	if s.closed {
+		return status.New(status.Canceled, "rpc server: stream has ended")
+	}
+	return s.write(codec.KindStream, 0, reply)
+}
+
+// Recv waits for the next message of the client and stores it in args,
+// every call must pass a pointer of the same type. It returns io.EOF
+// once the client has closed its side of the stream.
+func (s *ServerStream) Recv(args interface{}) error {
+	argv := reflect.ValueOf(args)
+	if argv.Kind() != reflect.Ptr || argv.IsNil() {
+		return status.New(status.InvalidArgument, "rpc server: stream args must be a non-nil pointer")
+	}
+	s.mtx.Lock()
+	typ := s.recvType
+	if typ == nil {
+		// the client waits for the first window, so nothing arrives
+		// before we know what to decode it into
+		s.recvType = argv.Type().Elem()
+	}
+	s.mtx.Unlock()
+	if typ == nil {
+		s.grant(codec.StreamWindow)
+	} else if typ != argv.Type().Elem() {
+		return status.New(status.InvalidArgument, "rpc server: stream args must be a *"+typ.String())
+	}
+	for {
+		s.mtx.Lock()
+		if len(s.queue) > 0 {
+			v := s.queue[0]
+			s.queue[0] = reflect.Value{}
+			s.queue = s.queue[1:]
+			n := 0
+			if s.consumed++; s.consumed >= codec.StreamWindow/2 {
+				n, s.consumed = s.consumed, 0
+			}
+			s.mtx.Unlock()
+			if n > 0 {
+				s.grant(n)
+			}
+			argv.Elem().Set(v.Elem())
+			return nil
+		}
+		err := s.recvErr
+		s.mtx.Unlock()
+		if err != nil {
+			return err
+		}
+		select {
+		case <-s.notify:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+// grant lets the client send n more messages.
+func (s *ServerStream) grant(n int) {
+	s.closeMtx.Lock()
+	defer s.closeMtx.Unlock()
+	if s.closed {
+		return
+	}
+	if err := s.write(codec.KindWindow, uint32(n), invalidRequest); err != nil {
+		log.Println("rpc server: write window error:", err)
+	}
+}
+
+func (s *ServerStream) write(kind codec.MessageKind, window uint32, body interface{}) error {
+	s.send_mtx.Lock()
+	defer s.send_mtx.Unlock()
+	h := s.h
+	h.Kind = kind
+	h.Window = window
+	return s.cc.Write(&h, body)
+}
+
+// push decodes the body of the current message into a new value
+// and queues it for Recv.
+func (s *ServerStream) push(cc codec.Codec) error {
+	s.mtx.Lock()
+	typ := s.recvType
+	s.mtx.Unlock()
+	if typ == nil {
+		return cc.ReadBody(nil) // sent without a window
+	}
+	v := reflect.New(typ)
+	if err := cc.ReadBody(v.Interface()); err != nil {
+		s.closeRecv(status.New(status.InvalidArgument, "rpc server: read stream args err: "+err.Error()))
+		return err
+	}
+	s.mtx.Lock()
+	s.queue = append(s.queue, v)
+	s.mtx.Unlock()
+	s.signal()
+	return nil
+}
+
+// closeRecv makes Recv return err once the queued messages are taken.
+func (s *ServerStream) closeRecv(err error) {
+	s.mtx.Lock()
+	if s.recvErr == nil {
+		s.recvErr = err
+	}
+	s.mtx.Unlock()
+	s.signal()
+}
+
+func (s *ServerStream) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// close ends the stream, it waits for a Send in progress.
+func (s *ServerStream) close() {
+	s.closeMtx.Lock()
+	defer s.closeMtx.Unlock()
+	s.closed = true
+}
+
+// serverStreams are the streams of a connection by Seq.
+type serverStreams struct {
+	mtx sync.Mutex
+	m   map[uint64]*ServerStream
+}
+
+func newServerStreams() *serverStreams {
+	return &serverStreams{m: make(map[uint64]*ServerStream)}
+}
+
+func (ss *serverStreams) add(seq uint64, s *ServerStream) {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	ss.m[seq] = s
+}
+
+func (ss *serverStreams) remove(seq uint64) {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	delete(ss.m, seq)
+}
+
+// receive handles a stream message of the client, messages of a stream
+// that has ended are dropped. Only the body of KindStream is still unread.
+func (ss *serverStreams) receive(cc codec.Codec, h *codec.Header) error {
+	ss.mtx.Lock()
+	s := ss.m[h.Seq]
+	ss.mtx.Unlock()
+	if h.Kind == codec.KindStream {
+		if s == nil {
+			return cc.ReadBody(nil)
+		}
+		return s.push(cc)
+	}
+	if s == nil {
+		return nil
+	}
+	switch h.Kind { // readRequest has read the empty body
+	case codec.KindStreamEnd:
+		s.closeRecv(io.EOF)
+	case codec.KindWindow:
+		s.sendWindow.Release(int(h.Window))
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Code tells what kind of error a call failed with.
+// It's carried by codec.Header.Code, so retries and circuit breakers can act on it.
+type Code uint32
+
+const (
+	OK                 Code = iota // not an error
+	Canceled                       // the caller cancelled the call
+	Unknown                        // an error without a code, such as a plain error of a method
+	InvalidArgument                // the request can't be decoded or is rejected by the method
+	DeadlineExceeded               // the call timed out
+	NotFound                       // the service or method doesn't exist
+	AlreadyExists                  // the entity the call tried to create exists
+	PermissionDenied               // the caller isn't allowed to make the call
+	ResourceExhausted              // a quota or limit is used up
+	FailedPrecondition             // the system isn't in the state the call needs
+	Aborted                        // the call was aborted, usually by a concurrency conflict
+	Unimplemented                  // the operation isn't supported
+	Internal                       // the server broke, such as a panicking method
+	Unavailable                    // the server can't be reached or is shutting down, retrying may help
+	Unauthenticated                // the caller has no valid credentials
+)
+
+var codeNames = [...]string{
+	OK:                 "OK",
+	Canceled:           "Canceled",
+	Unknown:            "Unknown",
+	InvalidArgument:    "InvalidArgument",
+	DeadlineExceeded:   "DeadlineExceeded",
+	NotFound:           "NotFound",
+	AlreadyExists:      "AlreadyExists",
+	PermissionDenied:   "PermissionDenied",
+	ResourceExhausted:  "ResourceExhausted",
+	FailedPrecondition: "FailedPrecondition",
+	Aborted:            "Aborted",
+	Unimplemented:      "Unimplemented",
+	Internal:           "Internal",
+	Unavailable:        "Unavailable",
+	Unauthenticated:    "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return fmt.Sprintf("Code(%d)", uint32(c))
+}
+
+// Error is an error with a Code. Methods return it to tell the client
+// what went wrong, the client gets an *Error for every failed call.
+type Error struct {
+	Code    Code              `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"` // optional, such as the invalid field or when to retry
+}
+
+// New returns an *Error with code and msg.
+func New(code Code, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+// Errorf returns an *Error with code and the formatted message.
+func Errorf(code Code, format string, a ...interface{}) *Error {
+	return New(code, fmt.Sprintf(format, a...))
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// WithDetails returns a copy of e with the key, value pairs added to its details.
+// WithDetails panics if len(kv) is odd.
+func (e *Error) WithDetails(kv ...string) *Error {
+	if len(kv)%2 == 1 {
+		panic("status: WithDetails got an odd number of input pairs")
+	}
+	out := *e
+	out.Details = make(map[string]string, len(e.Details)+len(kv)/2)
+	for k, v := range e.Details {
+		out.Details[k] = v
+	}
+	for i := 0; i < len(kv); i += 2 {
+		out.Details[kv[i]] = kv[i+1]
+	}
+	return &out
+}
+
+// Is reports whether target is an *Error with the same code,
+// and the same message unless the message of target is empty.
+// So errors.Is(err, status.ErrNotFound) holds for every NotFound error.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return e.Code == t.Code && (t.Message == "" || e.Message == t.Message)
+}
+
+// Errors matching every error of their code with errors.Is.
+var (
+	ErrCanceled           = &Error{Code: Canceled}
+	ErrUnknown            = &Error{Code: Unknown}
+	ErrInvalidArgument    = &Error{Code: InvalidArgument}
+	ErrDeadlineExceeded   = &Error{Code: DeadlineExceeded}
+	ErrNotFound           = &Error{Code: NotFound}
+	ErrAlreadyExists      = &Error{Code: AlreadyExists}
+	ErrPermissionDenied   = &Error{Code: PermissionDenied}
+	ErrResourceExhausted  = &Error{Code: ResourceExhausted}
+	ErrFailedPrecondition = &Error{Code: FailedPrecondition}
+	ErrAborted            = &Error{Code: Aborted}
+	ErrUnimplemented      = &Error{Code: Unimplemented}
+	ErrInternal           = &Error{Code: Internal}
+	ErrUnavailable        = &Error{Code: Unavailable}
+	ErrUnauthenticated    = &Error{Code: Unauthenticated}
+)
+
+// FromError returns the *Error in the chain of err.
+// Otherwise it returns an Unknown error with the message of err, and false.
+// context errors are mapped to Canceled and DeadlineExceeded.
+func FromError(err error) (*Error, bool) {
+	if err == nil {
+		return nil, true
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e, true
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return New(Canceled, err.Error()), false
+	case errors.Is(err, context.DeadlineExceeded):
+		return New(DeadlineExceeded, err.Error()), false
+	}
+	return New(Unknown, err.Error()), false
+}
+
+// CodeOf returns the code of err, OK for nil.
+func CodeOf(err error) Code {
+	if err == nil {
+		return OK
+	}
+	e, _ := FromError(err)
+	return e.Code
+}
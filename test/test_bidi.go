@@ -0,0 +1,145 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"ToyRPC/codec"
+	server "ToyRPC/service"
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Add sums every pair the client sends.
+func (c Calc) Add(stream *server.ServerStream, reply *int) error {
+	for {
+		var args Args
+		err := stream.Recv(&args)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		*reply += args.Num1 + args.Num2
+	}
+}
+
+// Echo replies the sum of every pair the client sends.
+func (c Calc) Echo(ctx context.Context, stream *server.ServerStream) error {
+	for {
+		var args Args
+		err := stream.Recv(&args)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(args.Num1 + args.Num2); err != nil {
+			return err
+		}
+	}
+}
+
+const bidiMessages = 100 // messages sent on every stream, more than codec.StreamWindow
+
+func addStream(client *client.Client) bool {
+	var reply int
+	stream, err := client.NewStream(context.Background(), "Calc.Add", &reply)
+	if err != nil {
+		log.Println("stream error:", err)
+		return false
+	}
+	for i := 1; i <= bidiMessages; i++ {
+		if err := stream.Send(&Args{Num1: i, Num2: i}); err != nil {
+			log.Println("send error:", err)
+			return false
+		}
+	}
+	_ = stream.CloseSend()
+	for stream.Next() {
+	}
+	return stream.Err() == nil && reply == bidiMessages*(bidiMessages+1)
+}
+
+func echoStream(client *client.Client) bool {
+	var reply int
+	stream, err := client.NewStream(context.Background(), "Calc.Echo", &reply)
+	if err != nil {
+		log.Println("stream error:", err)
+		return false
+	}
+	go func() {
+		for i := 1; i <= bidiMessages; i++ {
+			if err := stream.Send(&Args{Num1: i, Num2: 1}); err != nil {
+				return
+			}
+		}
+		_ = stream.CloseSend()
+	}()
+	n := 0
+	for stream.Next() {
+		if n++; reply != n+1 {
+			_ = stream.Close()
+			return false
+		}
+	}
+	return stream.Err() == nil && n == bidiMessages
+}
+
+func bidiCall(addr, codecType string) {
+	client, err := client.Dial("tcp", addr, &server.Option{CodecType: codecType})
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	// a stream nobody reads must not hold up the others
+	var watched int
+	stalled, err := client.Stream(context.Background(), "Calc.Watch", &Args{Num1: 1, Num2: 2}, &watched)
+	if err != nil {
+		log.Fatal("stream error:", err)
+	}
+	defer func() { _ = stalled.Close() }()
+
+	var ok int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f := addStream
+			if i%2 == 1 {
+				f = echoStream
+			}
+			if f(client) {
+				atomic.AddInt64(&ok, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	log.Printf("%s: %d of 20 streams ok in %s, expect 20", codecType, ok, time.Since(start).Round(time.Millisecond))
+}
+
+func TestBidiStream() {
+	log.SetFlags(0)
+	var c Calc
+	ser := server.NewServer()
+	if err := ser.Register(&c); err != nil {
+		log.Fatal("register error:", err)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go ser.Accept(l)
+
+	for _, codecType := range []string{codec.GobType, codec.JsonType, codec.BinaryType} {
+		bidiCall(l.Addr().String(), codecType)
+	}
+}
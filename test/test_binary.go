@@ -0,0 +1,225 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"ToyRPC/codec"
+	server "ToyRPC/service"
+	"ToyRPC/status"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"runtime"
+	"time"
+)
+
+func TestBinaryCodec() {
+	log.SetFlags(0)
+	addr := make(chan string)
+	go startNewServer(addr)
+	client, err := client.Dial("tcp", <-addr, &server.Option{CodecType: codec.BinaryType})
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	defer client.Close()
+	for i := 0; i < rpc_cnt; i++ {
+		args := &Args{Num1: i, Num2: -i * i}
+		var reply int
+		if err := client.Call(context.Background(), "Calc.Sum", args, &reply); err != nil {
+			log.Fatal("call Calc.Sum error:", err)
+		}
+		log.Printf("%d + %d = %d", args.Num1, args.Num2, reply)
+	}
+}
+
+// Tree refers to itself through pointers, registering Forest compiles
+// the schema of Tree before the schema of *Tree.
+type Tree struct {
+	Left, Right *Tree
+	Val         int
+}
+
+func (t *Tree) sum() int {
+	if t == nil {
+		return 0
+	}
+	return t.Left.sum() + t.Val + t.Right.sum()
+}
+
+type Forest int
+
+func (f Forest) Sum(t Tree, reply *int) error {
+	*reply = t.sum()
+	return nil
+}
+
+func newTree(depth, val int) *Tree {
+	if depth == 0 {
+		return nil
+	}
+	return &Tree{Left: newTree(depth-1, 2*val), Right: newTree(depth-1, 2*val+1), Val: val}
+}
+
+func TestBinaryRecursive() {
+	log.SetFlags(0)
+	var f Forest
+	ser := server.NewServer()
+	if err := ser.Register(&f); err != nil {
+		log.Fatal("register error:", err)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go ser.Accept(l)
+	defer l.Close()
+
+	tree := newTree(4, 1)
+	// round trip through the codec alone first
+	conn := new(loopback)
+	cc := codec.NewBinaryCodec(conn)
+	if err := cc.Write(&codec.Header{ServiceMethod: "Forest.Sum"}, tree); err != nil {
+		log.Fatal("write error:", err)
+	}
+	var h codec.Header
+	var got Tree
+	if err := cc.ReadHeader(&h); err != nil {
+		log.Fatal("read header error:", err)
+	}
+	if err := cc.ReadBody(&got); err != nil {
+		log.Fatal("read body error:", err)
+	}
+	if !reflect.DeepEqual(&got, tree) {
+		log.Fatalf("tree round trip: got %+v, want %+v", got, *tree)
+	}
+
+	cli, err := client.Dial("tcp", l.Addr().String(), &server.Option{CodecType: codec.BinaryType})
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	defer cli.Close()
+	var reply int
+	if err := cli.Call(context.Background(), "Forest.Sum", tree, &reply); err != nil {
+		log.Fatal("call Forest.Sum error:", err)
+	}
+	if reply != tree.sum() {
+		log.Fatalf("Forest.Sum = %d, want %d", reply, tree.sum())
+	}
+	log.Println("Forest.Sum =", reply)
+}
+
+// Dynamic replies values of any type, which the binary codec can't encode.
+type Dynamic int
+
+func (d Dynamic) Echo(args Args, reply *interface{}) error {
+	*reply = args.Num1
+	return nil
+}
+
+// TestBinaryRefused checks that a method the binary codec can't encode and a
+// reply too large for the peer fail with a status, leaving the connection usable.
+func TestBinaryRefused() {
+	log.SetFlags(0)
+	var c Calc
+	var d Dynamic
+	ser := server.NewServer()
+	if err := ser.Register(&c); err != nil {
+		log.Fatal("register error:", err)
+	}
+	if err := ser.Register(&d); err != nil {
+		log.Fatal("register error:", err)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go ser.Accept(l)
+	defer l.Close()
+
+	cli, err := client.Dial("tcp", l.Addr().String(), &server.Option{CodecType: codec.BinaryType})
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	defer cli.Close()
+	var reply int
+	err = cli.Call(context.Background(), "Dynamic.Echo", &Args{Num1: 1}, &reply)
+	log.Println("call Dynamic.Echo error:", err)
+	expect(status.CodeOf(err) == status.Unimplemented, "call Dynamic.Echo: error %v, want Unimplemented", err)
+	var blob []byte
+	err = cli.Call(context.Background(), "Calc.Blob", &Args{Num1: 65}, &blob)
+	log.Println("call Calc.Blob of 65MB error:", err)
+	expect(status.CodeOf(err) == status.ResourceExhausted, "call Calc.Blob of 65MB: error %v, want ResourceExhausted", err)
+	err = cli.Call(context.Background(), "Calc.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	expect(err == nil && reply == 3, "call Calc.Sum after the refused calls: reply %d, error %v", reply, err)
+}
+
+// loopback is an in-memory connection, what is written is read back.
+type loopback struct{ bytes.Buffer }
+
+func (l *loopback) Close() error { return nil }
+
+type benchArgs struct {
+	Name   string
+	ID     int64
+	Scores []float64
+	Tags   map[string]string
+}
+
+// codecResult is the cost of one write and read of a frame.
+type codecResult struct {
+	ns, allocs, bytes float64
+}
+
+func (r codecResult) String() string {
+	return fmt.Sprintf("%.0f ns/op\t%.1f allocs/op\t%.1f bytes/frame", r.ns, r.allocs, r.bytes)
+}
+
+// benchmarkCodec writes and reads n frames through newCodec on a single stream.
+func benchmarkCodec(newCodec codec.NewCodecFunc, n int) codecResult {
+	args := &benchArgs{
+		Name:   "Calc.Sum",
+		ID:     1 << 40,
+		Scores: []float64{1.5, 2.5, 3.5, 4.5},
+		Tags:   map[string]string{"region": "eu", "tier": "gold"},
+	}
+	conn := new(loopback)
+	cc := newCodec(conn)
+	h := &codec.Header{ServiceMethod: "Calc.Sum"}
+	var size int
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		h.Seq = uint64(i)
+		if err := cc.Write(h, args); err != nil {
+			log.Fatal("write error:", err)
+		}
+		size += conn.Len()
+		var rh codec.Header
+		var reply benchArgs
+		if err := cc.ReadHeader(&rh); err != nil {
+			log.Fatal("read header error:", err)
+		}
+		if err := cc.ReadBody(&reply); err != nil {
+			log.Fatal("read body error:", err)
+		}
+	}
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	return codecResult{
+		ns:     float64(elapsed.Nanoseconds()) / float64(n),
+		allocs: float64(after.Mallocs-before.Mallocs) / float64(n),
+		bytes:  float64(size) / float64(n),
+	}
+}
+
+// BenchmarkCodecs compares the binary codec with gob on a single stream,
+// so gob only pays for its type descriptors once.
+func BenchmarkCodecs() {
+	log.SetFlags(0)
+	const n = 100000
+	log.Println("gob:   ", benchmarkCodec(codec.NewGobCodec, n))
+	log.Println("binary:", benchmarkCodec(codec.NewBinaryCodec, n))
+}
@@ -0,0 +1,61 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// breakerCalls makes n calls of Calc.Sum one by one,
+// it returns how many went to the healthy and the slow server.
+func breakerCalls(xc *client.XClient, cc *callCounter, servers []string, n int) (int, int) {
+	cc.reset()
+	failed, _ := runCalls(1, n, func(i int) error { return sum(xc, context.Background(), i) })
+	expect(failed == 0, "%d calls failed", failed)
+	healthy, slow := cc.count(servers[0]), cc.count(servers[1])
+	log.Printf("%d calls: %d to the healthy server, %d to the slow one, breaker %s",
+		n, healthy, slow, xc.BreakerState(servers[1]))
+	return healthy, slow
+}
+
+func TestBreaker() {
+	log.SetFlags(0)
+	servers := []string{startCalcServer(), startCalcServer()}
+	d := client.NewMultiServerDiscovery(servers)
+	xc := client.NewXClient(d, client.RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetFailMode(client.Failfast, 0)
+	xc.SetBreaker(client.BreakerOption{
+		MinCalls:      4,
+		FailureRate:   0.5,
+		SlowCall:      time.Second / 10,
+		ProbeInterval: time.Second / 2,
+		OnStateChange: func(rpcAddr string, from, to client.BreakerState) {
+			log.Printf("breaker of the slow server: %s -> %s", from, to)
+		},
+	})
+	var slow int32 = 1
+	cc := countCalls(xc)
+	xc.UseEndpoint(func(ctx context.Context, rpcAddr, serviceMethod string, args, reply interface{}, invoker client.Invoker) error {
+		if rpcAddr == servers[1] && atomic.LoadInt32(&slow) == 1 {
+			time.Sleep(time.Second / 5)
+		}
+		return invoker(ctx, serviceMethod, args, reply)
+	})
+
+	// the breaker opens after 4 calls to the slow server,
+	// the other calls go to the healthy one
+	_, n := breakerCalls(xc, cc, servers, 20)
+	expect(n == 4 && xc.BreakerState(servers[1]) == client.BreakerOpen, "breaker didn't open after 4 slow calls")
+	// a single probe, which is slow, so the breaker opens again
+	time.Sleep(time.Second * 6 / 10)
+	_, n = breakerCalls(xc, cc, servers, 20)
+	expect(n == 1 && xc.BreakerState(servers[1]) == client.BreakerOpen, "%d probes, want 1 failing", n)
+	// the probe closes the breaker, then calls take turns again
+	atomic.StoreInt32(&slow, 0)
+	time.Sleep(time.Second * 6 / 10)
+	_, n = breakerCalls(xc, cc, servers, 20)
+	expect(n >= 9 && n <= 11 && xc.BreakerState(servers[1]) == client.BreakerClosed, "breaker didn't close after a good probe")
+}
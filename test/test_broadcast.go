@@ -0,0 +1,74 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"ToyRPC/status"
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// broadcastAll broadcasts serviceMethod of 1 and 2 with quorum, it returns
+// the results, the error and how long it took. Every reply must be 3.
+func broadcastAll(xc *client.XClient, ctx context.Context, serviceMethod string, quorum int) ([]client.BroadcastResult, error, time.Duration) {
+	var reply int
+	start := time.Now()
+	results, err := xc.BroadcastAll(ctx, serviceMethod, &Args{Num1: 1, Num2: 2}, &reply, quorum)
+	elapsed := time.Since(start)
+	log.Printf("broadcast all %s quorum %d: %d results in %s, error: %v", serviceMethod, quorum, len(results),
+		elapsed.Round(10*time.Millisecond), err)
+	succeeded := 0
+	for _, r := range results {
+		if r.Err == nil {
+			expect(*r.Reply.(*int) == 3, "%s replied %d, want 3", r.Addr, *r.Reply.(*int))
+			succeeded++
+		}
+	}
+	expect(succeeded == 0 || reply == 3, "reply %d, want 3", reply)
+	return results, err, elapsed
+}
+
+func TestBroadcastAll() {
+	log.SetFlags(0)
+	d := client.NewMultiServerDiscovery([]string{startCalcServer(), startCalcServer(), startResetServer()})
+	xc := client.NewXClient(d, client.RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// 2 replies and 1 failure
+	results, err, _ := broadcastAll(xc, context.Background(), "Calc.Sum", 0)
+	expect(err != nil && len(results) == 3, "every server must succeed")
+	// with a quorum of 0 it waits for the slow calls of Calc.Sleep despite the failure
+	results, err, elapsed := broadcastAll(xc, context.Background(), "Calc.Sleep", 0)
+	expect(err != nil && len(results) == 3 && elapsed >= time.Second, "wait for every server")
+	// with a quorum of 3 the failure puts it out of reach, so it returns
+	// at once and cancels the calls of Calc.SleepContext
+	before := atomic.LoadInt64(&cancelled)
+	results, err, elapsed = broadcastAll(xc, context.Background(), "Calc.SleepContext", 3)
+	expect(err != nil && len(results) == 1 && elapsed < time.Second, "return once the quorum is out of reach")
+	waitCancelled(before, 2, "quorum out of reach")
+	// 2 of 3 servers make a quorum
+	_, err, _ = broadcastAll(xc, context.Background(), "Calc.Sum", 2)
+	expect(err == nil, "quorum of 2 not reached")
+	// every call fails, the ones to Calc.Sleep time out
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/2)
+	defer cancel()
+	results, err, _ = broadcastAll(xc, ctx, "Calc.Sleep", 1)
+	timedOut := 0
+	for _, r := range results {
+		if status.CodeOf(r.Err) == status.DeadlineExceeded {
+			timedOut++
+		}
+	}
+	expect(err != nil && len(results) == 3 && timedOut == 2, "every call must fail, 2 of them time out")
+	_, err, _ = broadcastAll(xc, context.Background(), "Calc.Sum", 4)
+	expect(err != nil, "quorum of 4 of 3 servers reached")
+
+	// it returns as soon as the quorum is reached, the slow server is left behind
+	fast, slow := int64(0), int64(time.Second)
+	d = client.NewMultiServerDiscovery([]string{startDelayedCalcServer(&fast), startDelayedCalcServer(&fast), startDelayedCalcServer(&slow)})
+	xc2 := client.NewXClient(d, client.RandomSelect, nil)
+	defer func() { _ = xc2.Close() }()
+	results, err, elapsed = broadcastAll(xc2, context.Background(), "Calc.Sum", 2)
+	expect(err == nil && len(results) == 2 && elapsed < time.Second/2, "wait for the slow server despite the quorum")
+}
@@ -0,0 +1,66 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"ToyRPC/codec"
+	server "ToyRPC/service"
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var cancelled int64 // number of SleepContext calls that saw their context cancelled
+
+func (c Calc) SleepContext(ctx context.Context, args Args, reply *int) error {
+	select {
+	case <-time.After(time.Second * time.Duration(args.Num1)):
+		*reply = args.Num1 + args.Num2
+		return nil
+	case <-ctx.Done():
+		atomic.AddInt64(&cancelled, 1)
+		return ctx.Err()
+	}
+}
+
+func cancelCall(addr, codecType string) {
+	client, err := client.Dial("tcp", addr, &server.Option{CodecType: codecType})
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	defer client.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var reply int
+			// expect 2 - 5 cancelled on the server as well
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second+time.Second/2)
+			defer cancel()
+			err := client.Call(ctx, "Calc.SleepContext", &Args{Num1: i, Num2: i * i}, &reply)
+			if err != nil {
+				log.Printf("%s call Calc.SleepContext error: %v", codecType, err)
+			} else {
+				log.Printf("%s call Calc.SleepContext success: %d + %d = %d", codecType, i, i*i, reply)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCancel() {
+	log.SetFlags(0)
+	ch := make(chan string)
+	go startNewServer(ch)
+	addr := <-ch
+
+	time.Sleep(time.Second)
+	for _, codecType := range []string{codec.GobType, codec.JsonType, codec.BinaryType} {
+		atomic.StoreInt64(&cancelled, 0)
+		cancelCall(addr, codecType)
+		time.Sleep(time.Second / 10) // let the cancel messages arrive
+		log.Printf("%s: %d handlers cancelled, expect 3", codecType, atomic.LoadInt64(&cancelled))
+	}
+}
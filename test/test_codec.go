@@ -48,3 +48,56 @@ func TestCodec() {
 		log.Println("reply:", reply)
 	}
 }
+
+// TestJsonCodec calls Calc.Sum with the JSON codec, with sums above 2^53
+// as well, which don't fit a float64 and must be exact all the same.
+func TestJsonCodec() {
+	log.SetFlags(0)
+	var c Calc
+	ser := server.NewServer()
+	if err := ser.Register(&c); err != nil {
+		log.Fatal("register error:", err)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go ser.Accept(l)
+	defer l.Close()
+
+	connect, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	defer connect.Close()
+
+	if err := json.NewEncoder(connect).Encode(&server.Option{MagicNumber: server.MagicNumber, CodecType: codec.JsonType}); err != nil {
+		log.Fatal("write option error:", err)
+	}
+	cc := codec.NewJsonCodec(connect)
+	// send request & receive response
+	for i := 0; i < 2*rpc_cnt; i++ {
+		args := &Args{Num1: i, Num2: i * i}
+		if i >= rpc_cnt {
+			args.Num1 = 1<<53 + i
+		}
+		header := &codec.Header{
+			ServiceMethod: "Calc.Sum",
+			Seq:           uint64(i),
+		}
+		if err := cc.Write(header, args); err != nil {
+			log.Fatal("write error:", err)
+		}
+		if err := cc.ReadHeader(header); err != nil {
+			log.Fatal("read header error:", err)
+		}
+		var reply int64
+		if err := cc.ReadBody(&reply); err != nil {
+			log.Fatal("read body error:", err)
+		}
+		log.Printf("%d + %d = %d", args.Num1, args.Num2, reply)
+		want := int64(args.Num1) + int64(args.Num2)
+		expect(header.Error == "" && header.Seq == uint64(i) && reply == want,
+			"call Calc.Sum %d: reply %d, want %d, error %q", i, reply, want, header.Error)
+	}
+}
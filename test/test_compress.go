@@ -0,0 +1,106 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"ToyRPC/codec"
+	server "ToyRPC/service"
+	"bytes"
+	"context"
+	"log"
+	"math/rand"
+	"net"
+)
+
+// frameRecorder is a connection keeping what is written to be read back,
+// it records the flag of every frame, each written at once.
+type frameRecorder struct {
+	bytes.Buffer
+	flags []byte
+}
+
+func (r *frameRecorder) Write(p []byte) (int, error) {
+	r.flags = append(r.flags, p[0])
+	return r.Buffer.Write(p)
+}
+
+func (r *frameRecorder) Close() error {
+	return nil
+}
+
+// TestCompress writes messages below and above the threshold, and one that
+// doesn't shrink, to a connection for every compressor, and reads them back.
+func TestCompress() {
+	log.SetFlags(0)
+	small := []byte("toyrpc")
+	big := bytes.Repeat([]byte("toyrpc "), 1000)
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	bodies := [][]byte{small, big, random, small, big}
+	// raw below the threshold, compressed above, raw again if it doesn't shrink
+	want := []byte{0, 1, 0, 0, 1}
+
+	for _, name := range []string{codec.CompressGzip, codec.CompressFast, codec.CompressBest} {
+		newCodec, err := codec.NewCompressCodecFunc(codec.NewGobCodec, name, 256)
+		if err != nil {
+			log.Fatal("compress codec error:", err)
+		}
+		conn := &frameRecorder{}
+		cc := newCodec(conn)
+		raw := 0
+		for i, body := range bodies {
+			if err := cc.Write(&codec.Header{ServiceMethod: "Calc.Blob", Seq: uint64(i)}, body); err != nil {
+				log.Fatal("write error:", err)
+			}
+			raw += len(body)
+		}
+		log.Printf("%s: %d bytes of bodies sent in %d bytes, frame flags %v", name, raw, conn.Len(), conn.flags)
+		expect(bytes.Equal(conn.flags, want), "%s: frame flags %v, want %v", name, conn.flags, want)
+		expect(conn.Len() < raw-len(big), "%s: %d bytes sent, the big bodies not compressed", name, conn.Len())
+
+		cc = newCodec(conn)
+		for i, body := range bodies {
+			var h codec.Header
+			var got []byte
+			if err := cc.ReadHeader(&h); err != nil {
+				log.Fatal("read header error:", err)
+			}
+			if err := cc.ReadBody(&got); err != nil {
+				log.Fatal("read body error:", err)
+			}
+			expect(h.Seq == uint64(i) && bytes.Equal(got, body), "%s: message %d read back wrong", name, i)
+		}
+	}
+}
+
+// TestCompressCall calls small and large methods over one compressed connection
+// for every compressor, the client using a lower threshold than the server.
+func TestCompressCall() {
+	log.SetFlags(0)
+	var c Calc
+	ser := server.NewServer()
+	if err := ser.Register(&c); err != nil {
+		log.Fatal("register error:", err)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go ser.Accept(l)
+
+	for _, name := range []string{codec.CompressGzip, codec.CompressFast, codec.CompressBest} {
+		cli, err := client.Dial("tcp", l.Addr().String(), &server.Option{Compress: name, CompressThreshold: 16})
+		if err != nil {
+			log.Fatal("dial error:", err)
+		}
+		for i := 0; i < 3; i++ {
+			var reply int
+			err := cli.Call(context.Background(), "Calc.Sum", &Args{Num1: i, Num2: i}, &reply)
+			expect(err == nil && reply == 2*i, "%s: call Calc.Sum: reply %d, error %v", name, reply, err)
+			var blob []byte
+			err = cli.Call(context.Background(), "Calc.Blob", &Args{Num1: 1}, &blob)
+			expect(err == nil && len(blob) == 1<<20, "%s: call Calc.Blob: %d bytes, error %v", name, len(blob), err)
+		}
+		log.Printf("%s: small and 1MB replies over one connection", name)
+		_ = cli.Close()
+	}
+}
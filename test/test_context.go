@@ -0,0 +1,58 @@
+package test
+
+import (
+	"ToyRPC/client"
+	server "ToyRPC/service"
+	"ToyRPC/status"
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// waitCancelled waits for n more SleepContext calls to see their context cancelled.
+func waitCancelled(before, n int64, why string) {
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&cancelled)-before < n {
+		if time.Now().After(deadline) {
+			log.Fatalf("%s: %d handlers cancelled, want %d", why, atomic.LoadInt64(&cancelled)-before, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	log.Printf("%s: handler cancelled", why)
+}
+
+// TestMethodContext checks that the context of a method is cancelled
+// when the handle timeout fires and when the connection drops.
+func TestMethodContext() {
+	log.SetFlags(0)
+	addr := make(chan string)
+	go startNewServer(addr)
+	rpcAddr := <-addr
+
+	cli, err := client.Dial("tcp", rpcAddr, &server.Option{HandleTimeOut: time.Second / 10})
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	before := atomic.LoadInt64(&cancelled)
+	var reply int
+	err = cli.Call(context.Background(), "Calc.SleepContext", &Args{Num1: 5}, &reply)
+	if status.CodeOf(err) != status.DeadlineExceeded {
+		log.Fatalf("call Calc.SleepContext: %v, want DeadlineExceeded", err)
+	}
+	waitCancelled(before, 1, "handle timeout")
+	_ = cli.Close()
+
+	cli, err = client.Dial("tcp", rpcAddr)
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	before = atomic.LoadInt64(&cancelled)
+	done := cli.Go("Calc.SleepContext", &Args{Num1: 5}, &reply, make(chan *client.Call, 1)).Done
+	time.Sleep(time.Second / 10) // let the server start the call
+	_ = cli.Close()
+	waitCancelled(before, 1, "connection drop")
+	if call := <-done; call.Err == nil {
+		log.Fatal("call Calc.SleepContext succeeded on a closed connection")
+	}
+}
@@ -0,0 +1,74 @@
+package test
+
+import (
+	"ToyRPC/client"
+	server "ToyRPC/service"
+	"ToyRPC/status"
+	"context"
+	"log"
+	"time"
+)
+
+// Remaining replies the milliseconds left until the deadline of ctx, -1 if there's none.
+func (c Calc) Remaining(ctx context.Context, args Args, reply *int) error {
+	*reply = -1
+	if deadline, ok := ctx.Deadline(); ok {
+		*reply = int(time.Until(deadline) / time.Millisecond)
+	}
+	return nil
+}
+
+// remaining calls Calc.Remaining with handleTimeout on the connection and timeout on the caller's context.
+func remaining(rpcAddr string, handleTimeout, timeout time.Duration) int {
+	cli, err := client.Dial("tcp", rpcAddr, &server.Option{HandleTimeOut: handleTimeout})
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	defer func() { _ = cli.Close() }()
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var reply int
+	if err := cli.Call(ctx, "Calc.Remaining", &Args{}, &reply); err != nil {
+		log.Fatal("call Calc.Remaining error:", err)
+	}
+	log.Printf("handle timeout %s, caller timeout %s: the handler has %dms left", handleTimeout, timeout, reply)
+	return reply
+}
+
+// TestDeadline checks that a handler has the lesser of the caller's
+// deadline and the handle timeout, and that the server enforces it.
+func TestDeadline() {
+	log.SetFlags(0)
+	addr := make(chan string)
+	go startNewServer(addr)
+	rpcAddr := <-addr
+
+	within := func(ms, want int) bool { return ms <= want && ms > want-100 }
+	ms := remaining(rpcAddr, 0, 0)
+	expect(ms == -1, "no deadline: the handler has %dms left", ms)
+	ms = remaining(rpcAddr, 0, 2*time.Second)
+	expect(within(ms, 2000), "caller deadline only: %dms left, want 2000", ms)
+	ms = remaining(rpcAddr, time.Second/2, 2*time.Second)
+	expect(within(ms, 500), "handle timeout first: %dms left, want 500", ms)
+	ms = remaining(rpcAddr, 2*time.Second, time.Second/2)
+	expect(within(ms, 500), "caller deadline first: %dms left, want 500", ms)
+
+	// the handle timeout fires before the caller's deadline
+	cli, err := client.Dial("tcp", rpcAddr, &server.Option{HandleTimeOut: time.Second / 5})
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	defer func() { _ = cli.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	start := time.Now()
+	var reply int
+	err = cli.Call(ctx, "Calc.Sleep", &Args{Num1: 1}, &reply)
+	log.Printf("call Calc.Sleep error after %s: %v", time.Since(start).Round(10*time.Millisecond), err)
+	expect(status.CodeOf(err) == status.DeadlineExceeded && time.Since(start) < time.Second/2,
+		"handle timeout of 200ms not enforced before the caller's deadline of 3s")
+}
@@ -0,0 +1,95 @@
+package test
+
+import (
+	"ToyRPC/client"
+	server "ToyRPC/service"
+	"context"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// startDelayedCalcServer serves Calc on a new port, every call is held up by *delay nanoseconds.
+func startDelayedCalcServer(delay *int64) string {
+	var c Calc
+	ser := server.NewServer()
+	if err := ser.Register(&c); err != nil {
+		log.Fatal("register error:", err)
+	}
+	ser.Use(func(ctx context.Context, info *server.CallInfo, argv, replyv interface{}, next server.Handler) error {
+		time.Sleep(time.Duration(atomic.LoadInt64(delay)))
+		return next(ctx, argv, replyv)
+	})
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go ser.Accept(l)
+	return "tcp@" + l.Addr().String()
+}
+
+// ewmaCalls makes 200 calls of Calc.Sleep from 10 goroutines, it returns
+// how many calls went to each server, the slow one last, and how long they took.
+func ewmaCalls(xc *client.XClient, cc *callCounter, servers []string, mode string) ([]int, time.Duration) {
+	cc.reset()
+	failed, elapsed := runCalls(10, 200, func(i int) error {
+		var reply int
+		return xc.Call(context.Background(), "Calc.Sleep", &Args{Num1: 0, Num2: i}, &reply)
+	})
+	calls := cc.perServer(servers)
+	log.Printf("%s: calls per server %v, the slow one last, in %s", mode, calls, elapsed.Round(10*time.Millisecond))
+	expect(failed == 0, "%s: %d calls failed", mode, failed)
+	return calls, elapsed
+}
+
+func TestPeakEWMA() {
+	log.SetFlags(0)
+	var fast, slow int64 = 0, int64(50 * time.Millisecond)
+	servers := []string{startDelayedCalcServer(&fast), startDelayedCalcServer(&fast), startDelayedCalcServer(&slow)}
+
+	// a third of the calls go to the slow server
+	xc := client.NewXClient(client.NewMultiServerDiscovery(servers), client.RoundRobinSelect, nil)
+	calls, roundRobin := ewmaCalls(xc, countCalls(xc), servers, "round robin")
+	_ = xc.Close()
+	expect(calls[2] >= 60 && calls[2] <= 70, "round robin: %d calls to the slow server, want a third", calls[2])
+
+	// few calls go to the slow server, in a shorter time
+	xc = client.NewXClient(client.NewMultiServerDiscovery(servers), client.PeakEWMASelect, nil)
+	defer func() { _ = xc.Close() }()
+	cc := countCalls(xc)
+	xc.SetLatencyDecay(time.Second / 5)
+	calls, elapsed := ewmaCalls(xc, cc, servers, "peak EWMA")
+	for _, s := range servers {
+		stats := xc.LatencyStats()[s]
+		log.Printf("  %s: latency %s", s, stats.EWMA.Round(time.Microsecond))
+	}
+	expect(calls[2] <= 30 && elapsed < roundRobin, "peak EWMA: %d calls to the slow server in %s", calls[2], elapsed)
+
+	// the recovered server gets its share again once its latency decayed
+	atomic.StoreInt64(&slow, 0)
+	time.Sleep(time.Second)
+	calls, _ = ewmaCalls(xc, cc, servers, "peak EWMA, recovered")
+	expect(calls[2] >= 30, "peak EWMA, recovered: %d calls to the recovered server", calls[2])
+}
+
+// TestPeakEWMACold checks that a server never called doesn't take every
+// call while its calls are in flight: one server has a latency, the other
+// none, and 30 calls start at once.
+func TestPeakEWMACold() {
+	log.SetFlags(0)
+	delay := int64(20 * time.Millisecond)
+	servers := []string{startDelayedCalcServer(&delay), startDelayedCalcServer(&delay)}
+	xc := client.NewXClient(client.NewMultiServerDiscovery(servers), client.PeakEWMASelect, nil)
+	defer func() { _ = xc.Close() }()
+	cc := countCalls(xc)
+	expect(sum(xc, context.Background(), 1) == nil, "call Calc.Sum failed")
+	warm, cold := servers[0], servers[1]
+	if cc.count(cold) == 1 {
+		warm, cold = cold, warm
+	}
+	cc.reset()
+	failed, _ := runCalls(30, 30, func(i int) error { return sum(xc, context.Background(), i) })
+	log.Printf("peak EWMA, cold start: %d calls to the warm server, %d to the cold one", cc.count(warm), cc.count(cold))
+	expect(failed == 0 && cc.count(warm) > 0 && cc.count(cold) > cc.count(warm), "expect most calls but not all on the cold server")
+}
@@ -0,0 +1,96 @@
+package test
+
+import (
+	"ToyRPC/client"
+	server "ToyRPC/service"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// failModeCalls makes n calls of Calc.Sum one by one with the XClient set up by setup,
+// the calls to slow are held up for a second. It returns how many failed,
+// how long they took and the attempts made on every server.
+func failModeCalls(name string, servers []string, slow string, n int, setup func(xc *client.XClient)) (int, time.Duration, *callCounter) {
+	d := client.NewMultiServerDiscovery(servers)
+	xc := client.NewXClient(d, client.RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	setup(xc)
+	cc := countCalls(xc)
+	xc.UseEndpoint(func(ctx context.Context, rpcAddr, serviceMethod string, args, reply interface{}, invoker client.Invoker) error {
+		if rpcAddr == slow {
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return invoker(ctx, serviceMethod, args, reply)
+	})
+	failed, elapsed := runCalls(1, n, func(i int) error { return sum(xc, context.Background(), i) })
+	log.Printf("%s: %d of %d calls failed, attempts per server %v in %s", name, failed, n,
+		cc.perServer(servers), elapsed.Round(10*time.Millisecond))
+	return failed, elapsed, cc
+}
+
+// startCalcServer serves Calc on a new port.
+func startCalcServer() string {
+	var c Calc
+	ser := server.NewServer()
+	if err := ser.Register(&c); err != nil {
+		log.Fatal("register error:", err)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go ser.Accept(l)
+	return "tcp@" + l.Addr().String()
+}
+
+func TestFailMode() {
+	log.SetFlags(0)
+	alive, reset := startCalcServer(), startResetServer()
+	servers := []string{reset, alive}
+	// round robin takes turns, so 5 of the 10 calls pick the reset server first
+
+	// those 5 calls fail with a single attempt
+	failed, _, cc := failModeCalls("failfast", servers, "", 10, func(xc *client.XClient) {
+		xc.SetFailMode(client.Failfast, 0)
+	})
+	expect(failed == 5 && cc.total() == 10, "failfast: %d failed in %d attempts", failed, cc.total())
+	// every call succeeds, the failed ones on the other server, Failover is the default.
+	// A retried call picks both servers, so every call but maybe the first one
+	// picks the reset server first
+	for _, mode := range []string{"failover", "default"} {
+		failed, _, cc = failModeCalls(mode, servers, "", 10, func(xc *client.XClient) {
+			if mode == "failover" {
+				xc.SetFailMode(client.Failover, 0)
+			}
+		})
+		expect(failed == 0 && cc.count(alive) == 10 && cc.count(reset) >= 9,
+			"%s: %d failed, attempts per server %v", mode, failed, cc.perServer(servers))
+	}
+	// those 5 calls fail after 3 attempts there, hedged or not
+	for _, hedged := range []bool{false, true} {
+		failed, _, cc = failModeCalls(fmt.Sprintf("failtry, hedged %v", hedged), servers, "", 10, func(xc *client.XClient) {
+			xc.SetFailMode(client.Failtry, 0)
+			if hedged {
+				xc.SetHedgePolicy(client.HedgePolicy{Delay: time.Second})
+				xc.MarkIdempotent("Calc.Sum")
+			}
+		})
+		expect(failed == 5 && cc.count(reset) == 15 && cc.count(alive) == 5,
+			"failtry, hedged %v: %d failed, attempts per server %v", hedged, failed, cc.perServer(servers))
+	}
+	// every call succeeds in no time, the reset and the slow server are raced
+	slow := startCalcServer()
+	servers = []string{reset, slow, alive}
+	failed, elapsed, cc := failModeCalls("forking", servers, slow, 10, func(xc *client.XClient) {
+		xc.SetFailMode(client.Forking, 0)
+	})
+	expect(failed == 0 && cc.total() == 30 && elapsed < time.Second,
+		"forking: %d failed in %d attempts, in %s", failed, cc.total(), elapsed)
+}
@@ -0,0 +1,105 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"ToyRPC/registry"
+	"context"
+	"fmt"
+	"log"
+	"net/http/httptest"
+	"time"
+)
+
+// hashCalls makes n calls of serviceMethod for every key at once,
+// it returns the servers the calls of every key went to.
+func hashCalls(xc *client.XClient, cc *callCounter, serviceMethod string, keys []string, n int) map[string]map[string]bool {
+	cc.reset()
+	failed, _ := runCalls(len(keys)*n, len(keys)*n, func(i int) error {
+		var reply int
+		return xc.Call(client.WithRoutingKey(context.Background(), keys[i%len(keys)]), serviceMethod, &Args{Num1: 1}, &reply)
+	})
+	expect(failed == 0, "%d calls of %s failed", failed, serviceMethod)
+	return cc.keyServers()
+}
+
+func TestConsistentHash() {
+	log.SetFlags(0)
+	reg := registry.NewRegistry(0)
+	ts := httptest.NewServer(reg)
+	defer ts.Close()
+	for i := 0; i < 3; i++ {
+		registry.Heartbeat(ts.URL, startCalcServer(), 0)
+	}
+
+	d := client.NewRegistryDiscovery(ts.URL, time.Second/10)
+	xc := client.NewXClient(d, client.ConsistentHashSelect, nil)
+	defer func() { _ = xc.Close() }()
+	cc := countCalls(xc)
+	// another XClient on the discovery, its calls don't count for the load bound of xc
+	other := client.NewXClient(d, client.ConsistentHashSelect, nil)
+	defer func() { _ = other.Close() }()
+
+	// the load bound moves keys off busy servers, leave it out for now
+	d.SetHashRing(0, -1)
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user-%d", i)
+	}
+	// the keys are spread over the 3 servers, the calls of each key on one server
+	before := hashCalls(xc, cc, "Calc.Sum", keys, 2)
+	perServer := make(map[string]int)
+	split := 0
+	for _, servers := range before {
+		if len(servers) > 1 {
+			split++
+		}
+		for s := range servers {
+			perServer[s]++
+		}
+	}
+	log.Printf("1000 keys, 2 calls each: %d servers got keys %v, %d keys on several servers", len(perServer), perServer, split)
+	expect(len(before) == 1000 && len(perServer) == 3 && split == 0, "keys not on a server each")
+	for s, n := range perServer {
+		expect(n >= 200, "%s got %d of 1000 keys", s, n)
+	}
+
+	// about a quarter of the keys move, all of them to the new server
+	added := startCalcServer()
+	registry.Heartbeat(ts.URL, added, 0)
+	time.Sleep(time.Second / 5) // let the discovery refresh
+	after := hashCalls(xc, cc, "Calc.Sum", keys, 1)
+	moved, movedElsewhere := 0, 0
+	for key, servers := range after {
+		for s := range servers {
+			if !before[key][s] {
+				moved++
+				if s != added {
+					movedElsewhere++
+				}
+			}
+		}
+	}
+	log.Printf("a server added: %d of 1000 keys moved, %d not to the new server", moved, movedElsewhere)
+	expect(moved >= 150 && moved <= 350 && movedElsewhere == 0, "%d keys moved, %d not to the new server", moved, movedElsewhere)
+
+	// the calls without a key are spread over the servers
+	cc.reset()
+	failed, _ := runCalls(1, 30, func(i int) error { return sum(xc, context.Background(), i) })
+	keyless := 0
+	for _, n := range cc.counts {
+		if n > 0 {
+			keyless++
+		}
+	}
+	log.Printf("30 calls without a key on %d servers", keyless)
+	expect(failed == 0 && keyless > 1, "30 calls without a key on %d servers", keyless)
+
+	// 40 concurrent calls of a hot key go to a single server
+	// without a load bound, and spill over to other servers with one
+	for _, loadFactor := range []float64{-1, 1.25} {
+		d.SetHashRing(0, loadFactor)
+		hot := hashCalls(xc, cc, "Calc.Sleep", []string{"hot"}, 40)
+		log.Printf("load factor %v: 40 calls of a hot key on %d servers", loadFactor, len(hot["hot"]))
+		expect((loadFactor < 1) == (len(hot["hot"]) == 1), "load factor %v: hot key on %d servers", loadFactor, len(hot["hot"]))
+	}
+}
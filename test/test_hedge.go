@@ -0,0 +1,55 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+// hedgeCalls makes 60 calls of Calc.Sleep one by one, it returns how many
+// copies were sent and the sorted latencies of the calls.
+func hedgeCalls(servers []string, idempotent bool, policy client.HedgePolicy, name string) (int, []time.Duration) {
+	xc := client.NewXClient(client.NewMultiServerDiscovery(servers), client.RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetFailMode(client.Failfast, 0)
+	xc.SetHedgePolicy(policy)
+	if idempotent {
+		xc.MarkIdempotent("Calc.Sum")
+	}
+	cc := countCalls(xc)
+	var latencies []time.Duration
+	failed, _ := runCalls(1, 60, func(i int) error {
+		start := time.Now()
+		defer func() { latencies = append(latencies, time.Since(start)) }()
+		return sum(xc, context.Background(), i)
+	})
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	log.Printf("%s: 60 calls, %d copies sent, p50 %s, p90 %s, max %s", name, cc.total(),
+		latencies[30].Round(time.Millisecond), latencies[54].Round(time.Millisecond), latencies[59].Round(time.Millisecond))
+	expect(failed == 0, "%s: %d calls failed", name, failed)
+	return cc.total(), latencies
+}
+
+func TestHedge() {
+	log.SetFlags(0)
+	var fast, slow int64 = 0, int64(200 * time.Millisecond)
+	servers := []string{startDelayedCalcServer(&fast), startDelayedCalcServer(&fast), startDelayedCalcServer(&slow)}
+	policy := client.HedgePolicy{Delay: 20 * time.Millisecond}
+
+	// a third of the calls take 200ms, the method isn't marked idempotent
+	copies, latencies := hedgeCalls(servers, false, policy, "not idempotent")
+	expect(copies == 60 && latencies[40] >= 200*time.Millisecond, "not idempotent: %d copies, want no hedges", copies)
+	// every call takes about 20ms at most, the slow calls are hedged; round robin
+	// picks the server of the hedge too, so half of the calls go to the slow server
+	copies, latencies = hedgeCalls(servers, true, policy, "hedged after 20ms")
+	expect(copies > 60 && latencies[59] < 100*time.Millisecond, "hedged after 20ms: %d copies, max %s", copies, latencies[59])
+	// the slow calls are hedged after the 90th percentile of the latencies,
+	// a few milliseconds, once 10 calls were made
+	copies, latencies = hedgeCalls(servers, true, client.HedgePolicy{Delay: 20 * time.Millisecond, Percentile: 0.9}, "hedged after p90")
+	expect(copies > 60 && latencies[50] < 15*time.Millisecond, "hedged after p90: %d copies, p85 %s", copies, latencies[50])
+	// about 5 hedges, so most of the slow calls aren't hedged
+	copies, latencies = hedgeCalls(servers, true, client.HedgePolicy{Delay: 20 * time.Millisecond, MaxExtraLoad: 0.1}, "hedged for 10% more load")
+	expect(copies > 60 && copies <= 68 && latencies[50] >= 200*time.Millisecond, "hedged for 10%% more load: %d copies", copies)
+}
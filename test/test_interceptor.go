@@ -0,0 +1,184 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"ToyRPC/metadata"
+	server "ToyRPC/service"
+	"ToyRPC/status"
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// trace records the steps of calls in order.
+type trace struct {
+	mtx   sync.Mutex
+	steps []string
+}
+
+func (t *trace) add(step string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.steps = append(t.steps, step)
+}
+
+// take returns the steps recorded so far and forgets them.
+func (t *trace) take() string {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	steps := strings.Join(t.steps, " ")
+	t.steps = nil
+	return steps
+}
+
+// serverInterceptor records name before and after the rest of the chain.
+func (t *trace) serverInterceptor(name string) server.Interceptor {
+	return func(ctx context.Context, info *server.CallInfo, argv, replyv interface{}, next server.Handler) error {
+		t.add(name + ">")
+		err := next(ctx, argv, replyv)
+		t.add("<" + name)
+		return err
+	}
+}
+
+// authInterceptor short-circuits the calls without the token "secret".
+func (t *trace) authInterceptor(ctx context.Context, info *server.CallInfo, argv, replyv interface{}, next server.Handler) error {
+	if info.Metadata.Get("token") != "secret" {
+		t.add("denied")
+		return status.Errorf(status.PermissionDenied, "%s needs a token", info.ServiceMethod)
+	}
+	t.add("auth")
+	return next(ctx, argv, replyv)
+}
+
+// startTracedServer serves Calc and Forest, every call goes through the global
+// interceptors g1 and g2, the calls of Calc through s1 and auth as well.
+func startTracedServer(t *trace) string {
+	var c Calc
+	var f Forest
+	ser := server.NewServer()
+	if err := ser.Register(&c); err != nil {
+		log.Fatal("register error:", err)
+	}
+	if err := ser.Register(&f); err != nil {
+		log.Fatal("register error:", err)
+	}
+	ser.Use(t.serverInterceptor("g1"), t.serverInterceptor("g2"))
+	if err := ser.UseService("Calc", t.serverInterceptor("s1"), t.authInterceptor); err != nil {
+		log.Fatal("use service error:", err)
+	}
+	expect(ser.UseService("Missing", t.serverInterceptor("s1")) != nil, "interceptors added to a missing service")
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go ser.Accept(l)
+	return "tcp@" + l.Addr().String()
+}
+
+// TestServerInterceptor checks the order of the global and per service
+// interceptors, and that an interceptor can short-circuit a call.
+func TestServerInterceptor() {
+	log.SetFlags(0)
+	t := &trace{}
+	rpcAddr := startTracedServer(t)
+	cli, err := client.XDial(rpcAddr)
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "token", "secret")
+	var reply int
+	err = cli.Call(ctx, "Calc.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	steps := t.take()
+	log.Printf("call Calc.Sum: %s", steps)
+	expect(err == nil && reply == 3 && steps == "g1> g2> s1> auth <s1 <g2 <g1", "call Calc.Sum: reply %d, error %v", reply, err)
+
+	// auth returns without calling the method
+	reply = 0
+	err = cli.Call(context.Background(), "Calc.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	steps = t.take()
+	log.Printf("call Calc.Sum without a token: %s, error: %v", steps, err)
+	expect(status.CodeOf(err) == status.PermissionDenied && reply == 0 && steps == "g1> g2> s1> denied <s1 <g2 <g1",
+		"call Calc.Sum without a token: reply %d, error %v", reply, err)
+
+	// the interceptors of Calc don't wrap Forest
+	tree := newTree(3, 1)
+	err = cli.Call(context.Background(), "Forest.Sum", tree, &reply)
+	steps = t.take()
+	log.Printf("call Forest.Sum: %s", steps)
+	expect(err == nil && reply == tree.sum() && steps == "g1> g2> <g2 <g1", "call Forest.Sum: reply %d, error %v", reply, err)
+}
+
+// clientInterceptor records name before and after the rest of the chain,
+// it sends the token "secret" and refuses the calls of refused.
+func (t *trace) clientInterceptor(name, refused string) client.Interceptor {
+	return func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker client.Invoker) error {
+		if serviceMethod == refused {
+			t.add(name + " refused")
+			return status.Errorf(status.InvalidArgument, "%s refused by %s", serviceMethod, name)
+		}
+		t.add(name + ">")
+		err := invoker(metadata.AppendToOutgoingContext(ctx, "token", "secret"), serviceMethod, args, reply)
+		t.add("<" + name)
+		return err
+	}
+}
+
+// TestClientInterceptor checks the order of the interceptors of Client,
+// XClient and its endpoints, that they can add metadata and short-circuit a call.
+func TestClientInterceptor() {
+	log.SetFlags(0)
+	t := &trace{}
+	servers := []string{startTracedServer(t), startTracedServer(t)}
+
+	// c1 sends the token the server wants, c2 refuses Calc.Div
+	cli, err := client.XDial(servers[0])
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	defer func() { _ = cli.Close() }()
+	cli.Use(t.clientInterceptor("c1", ""), t.clientInterceptor("c2", "Calc.Div"))
+	var reply int
+	err = cli.Call(context.Background(), "Calc.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	steps := t.take()
+	log.Printf("client call Calc.Sum: %s", steps)
+	expect(err == nil && reply == 3 && steps == "c1> c2> g1> g2> s1> auth <s1 <g2 <g1 <c2 <c1",
+		"client call Calc.Sum: reply %d, error %v", reply, err)
+	err = cli.Call(context.Background(), "Calc.Div", &Args{Num1: 1, Num2: 2}, &reply)
+	steps = t.take()
+	log.Printf("client call Calc.Div: %s, error: %v", steps, err)
+	expect(status.CodeOf(err) == status.InvalidArgument && steps == "c1> c2 refused <c1", "client call Calc.Div not refused")
+
+	// x1 and x2 wrap the whole call, e1 and e2 every call to a server
+	xc := client.NewXClient(client.NewMultiServerDiscovery(servers), client.RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.Use(t.clientInterceptor("x1", ""), t.clientInterceptor("x2", "Calc.Div"))
+	xc.UseEndpoint(func(ctx context.Context, rpcAddr, serviceMethod string, args, reply interface{}, invoker client.Invoker) error {
+		expect(rpcAddr == servers[0] || rpcAddr == servers[1], "endpoint interceptor got unknown server %s", rpcAddr)
+		t.add("e1>")
+		err := invoker(ctx, serviceMethod, args, reply)
+		t.add("<e1")
+		return err
+	}, func(ctx context.Context, rpcAddr, serviceMethod string, args, reply interface{}, invoker client.Invoker) error {
+		return t.clientInterceptor("e2", "")(ctx, serviceMethod, args, reply, invoker)
+	})
+	err = xc.Call(context.Background(), "Calc.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	steps = t.take()
+	log.Printf("xclient call Calc.Sum: %s", steps)
+	expect(err == nil && reply == 3 && steps == "x1> x2> e1> e2> g1> g2> s1> auth <s1 <g2 <g1 <e2 <e1 <x2 <x1",
+		"xclient call Calc.Sum: reply %d, error %v", reply, err)
+	err = xc.Call(context.Background(), "Calc.Div", &Args{Num1: 1, Num2: 2}, &reply)
+	steps = t.take()
+	log.Printf("xclient call Calc.Div: %s, error: %v", steps, err)
+	expect(status.CodeOf(err) == status.InvalidArgument && steps == "x1> x2 refused <x1", "xclient call Calc.Div not refused")
+	// the interceptors of XClient wrap the broadcast once, the others every server
+	err = xc.Broadcast(context.Background(), "Calc.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	steps = t.take()
+	log.Printf("xclient broadcast Calc.Sum: %s", steps)
+	expect(err == nil && strings.Count(steps, "x1>") == 1 && strings.Count(steps, "e1>") == 2 && strings.Count(steps, "auth") == 2,
+		"xclient broadcast Calc.Sum: error %v", err)
+}
@@ -0,0 +1,172 @@
+package test
+
+import (
+	server "ToyRPC/service"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// jsonrpcReply is a JSON-RPC 2.0 response as a client in another language sees it.
+type jsonrpcReply struct {
+	ID     json.RawMessage `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code int `json:"code"`
+		Data struct {
+			Status  string            `json:"status"`
+			Details map[string]string `json:"details"`
+		} `json:"data"`
+	} `json:"error"`
+}
+
+// expectJSONRPC checks the reply with id, it must carry result if code is 0,
+// otherwise an error with code and, if st isn't empty, that status.
+func expectJSONRPC(r *jsonrpcReply, id string, code int, st, result string) {
+	if string(r.ID) != id {
+		log.Fatalf("jsonrpc: reply id %s, want %s", r.ID, id)
+	}
+	if code == 0 {
+		if r.Error != nil || string(r.Result) != result {
+			log.Fatalf("jsonrpc %s: result %s, error %+v, want result %s", id, r.Result, r.Error, result)
+		}
+		return
+	}
+	if r.Error == nil || r.Error.Code != code || (st != "" && r.Error.Data.Status != st) {
+		log.Fatalf("jsonrpc %s: error %+v, want code %d status %q", id, r.Error, code, st)
+	}
+}
+
+// expectJSONRPCBatch checks the replies of a batch, which come in any order.
+func expectJSONRPCBatch(replies []jsonrpcReply, want map[string]func(r *jsonrpcReply)) {
+	if len(replies) != len(want) {
+		log.Fatalf("jsonrpc batch: %d replies, want %d", len(replies), len(want))
+	}
+	for i := range replies {
+		check, ok := want[string(replies[i].ID)]
+		if !ok {
+			log.Fatalf("jsonrpc batch: unexpected reply id %s", replies[i].ID)
+		}
+		check(&replies[i])
+	}
+}
+
+func startJSONRPCServer() (tcpAddr, httpURL string) {
+	var c Calc
+	ser := server.NewServer(server.WithJSONRPCHandleTimeout(time.Second / 10))
+	if err := ser.Register(&c); err != nil {
+		log.Fatal("register error:", err)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go ser.Accept(l)
+	hl, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go func() { _ = http.Serve(hl, ser) }()
+	return l.Addr().String(), "http://" + hl.Addr().String() + "/_toyrpc_"
+}
+
+const jsonrpcBatch = `[
+	{"jsonrpc":"2.0","method":"Calc.Sum","params":{"Num1":1,"Num2":2},"id":3},
+	{"jsonrpc":"2.0","method":"Calc.Sum","params":{"Num1":1,"Num2":2}},
+	{"jsonrpc":"1.0","method":"Calc.Sum"},
+	{"jsonrpc":"2.0","method":"Calc.Missing","id":4},
+	{"jsonrpc":"2.0","method":"Calc.Checked","params":{"Num1":1,"Num2":0},"id":5},
+	{"jsonrpc":"2.0","method":"Calc.Div","params":{"Num1":1,"Num2":0},"id":6},
+	{"jsonrpc":"2.0","method":"Calc.Sleep","params":{"Num1":1},"id":7}
+]`
+
+var jsonrpcBatchWant = map[string]func(r *jsonrpcReply){
+	"3":    func(r *jsonrpcReply) { expectJSONRPC(r, "3", 0, "", "3") },
+	"null": func(r *jsonrpcReply) { expectJSONRPC(r, "null", server.JSONRPCInvalidRequest, "", "") },
+	"4":    func(r *jsonrpcReply) { expectJSONRPC(r, "4", server.JSONRPCMethodNotFound, "NotFound", "") },
+	"5": func(r *jsonrpcReply) {
+		expectJSONRPC(r, "5", server.JSONRPCInvalidParams, "InvalidArgument", "")
+		if r.Error.Data.Details["field"] != "Num2" {
+			log.Fatalf("jsonrpc 5: details %v, want field Num2", r.Error.Data.Details)
+		}
+	},
+	"6": func(r *jsonrpcReply) { expectJSONRPC(r, "6", server.JSONRPCInternalError, "Internal", "") },
+	"7": func(r *jsonrpcReply) { expectJSONRPC(r, "7", server.JSONRPCServerError, "DeadlineExceeded", "") },
+}
+
+// TestJSONRPC calls Calc as a client in another language would,
+// over raw TCP and HTTP POST.
+func TestJSONRPC() {
+	log.SetFlags(0)
+	tcpAddr, httpURL := startJSONRPCServer()
+
+	conn, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	defer conn.Close()
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	send := func(msg string) {
+		if _, err := conn.Write([]byte(msg + "\n")); err != nil {
+			log.Fatal("jsonrpc write error:", err)
+		}
+	}
+	read := func(v interface{}) {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := dec.Decode(v); err != nil {
+			log.Fatal("jsonrpc read error:", err)
+		}
+	}
+	var r jsonrpcReply
+	send(`{"jsonrpc":"2.0","method":"Calc.Sum","params":[{"Num1":1,"Num2":2}],"id":1}`)
+	read(&r)
+	expectJSONRPC(&r, "1", 0, "", "3")
+	// a notification gets no reply, so the next one is of the request sent after it
+	send(`{"jsonrpc":"2.0","method":"Calc.Sum","params":{"Num1":1,"Num2":2}}`)
+	send(`{"jsonrpc":"2.0","method":"Calc.Sum","params":{"Num1":2,"Num2":2},"id":"two"}`)
+	r = jsonrpcReply{}
+	read(&r)
+	expectJSONRPC(&r, `"two"`, 0, "", "4")
+	// an invalid request without an id is answered with a null id
+	send(`{"jsonrpc":"1.0","method":"Calc.Sum"}`)
+	r = jsonrpcReply{}
+	read(&r)
+	expectJSONRPC(&r, "null", server.JSONRPCInvalidRequest, "", "")
+	send(jsonrpcBatch)
+	var replies []jsonrpcReply
+	read(&replies)
+	expectJSONRPCBatch(replies, jsonrpcBatchWant)
+	log.Println("jsonrpc over tcp: ok")
+
+	post := func(body string) *http.Response {
+		resp, err := http.Post(httpURL, "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			log.Fatal("jsonrpc post error:", err)
+		}
+		return resp
+	}
+	resp := post(`{"jsonrpc":"2.0","method":"Calc.Sum","params":{"Num1":1,"Num2":2},"id":1}`)
+	r = jsonrpcReply{}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		log.Fatal("jsonrpc http read error:", err)
+	}
+	resp.Body.Close()
+	expectJSONRPC(&r, "1", 0, "", "3")
+	resp = post(`[{"jsonrpc":"2.0","method":"Calc.Sum","params":{"Num1":1,"Num2":2}}]`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		log.Fatalf("jsonrpc http: notifications got status %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	resp = post(jsonrpcBatch)
+	replies = nil
+	if err := json.NewDecoder(resp.Body).Decode(&replies); err != nil {
+		log.Fatal("jsonrpc http read error:", err)
+	}
+	resp.Body.Close()
+	expectJSONRPCBatch(replies, jsonrpcBatchWant)
+	log.Println("jsonrpc over http: ok")
+}
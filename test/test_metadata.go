@@ -0,0 +1,58 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"ToyRPC/codec"
+	"ToyRPC/metadata"
+	server "ToyRPC/service"
+	"context"
+	"log"
+)
+
+// Whoami replies with the user of the request metadata
+// and tells the trace id back in a trailer.
+func (c Calc) Whoami(ctx context.Context, args Args, reply *string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	*reply = md.Get("user")
+	metadata.SetTrailer(ctx, metadata.Pairs("trace-id", md.Get("trace-id")))
+	metadata.SetTrailer(ctx, metadata.Pairs("sum", "0"))
+	return nil
+}
+
+func TestMetadata() {
+	log.SetFlags(0)
+	addr := make(chan string)
+	go startNewServer(addr)
+	rpcAddr := <-addr
+	for _, codecType := range []string{codec.GobType, codec.JsonType, codec.BinaryType} {
+		cli, err := client.Dial("tcp", rpcAddr, &server.Option{CodecType: codecType})
+		if err != nil {
+			log.Fatal("dial error:", err)
+		}
+		ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("user", "alice"))
+		ctx = metadata.AppendToOutgoingContext(ctx, "trace-id", codecType)
+		var trailer metadata.MD
+		var reply string
+		if err := cli.Call(metadata.WithTrailer(ctx, &trailer), "Calc.Whoami", &Args{}, &reply); err != nil {
+			log.Fatal("call Calc.Whoami error:", err)
+		}
+		if reply != "alice" {
+			log.Fatalf("%s: Calc.Whoami = %q, want the user of the metadata", codecType, reply)
+		}
+		if trailer.Get("trace-id") != codecType || trailer.Get("sum") != "0" {
+			log.Fatalf("%s: trailer %v, want trace-id %s and sum 0", codecType, trailer, codecType)
+		}
+
+		// the trailer is also on the Call, and a call without metadata has none
+		var anonymous string
+		call := <-cli.Go("Calc.Whoami", &Args{}, &anonymous, make(chan *client.Call, 1)).Done
+		if call.Err != nil {
+			log.Fatal("call Calc.Whoami error:", call.Err)
+		}
+		if anonymous != "" || call.Trailer.Get("trace-id") != "" || call.Trailer.Get("sum") != "0" {
+			log.Fatalf("%s: reply %q, trailer %v without metadata", codecType, anonymous, call.Trailer)
+		}
+		log.Printf("%s: metadata and trailers ok", codecType)
+		_ = cli.Close()
+	}
+}
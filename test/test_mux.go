@@ -0,0 +1,231 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"ToyRPC/codec"
+	server "ToyRPC/service"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blob replies Num1 megabytes.
+func (c Calc) Blob(args Args, reply *[]byte) error {
+	*reply = make([]byte, args.Num1<<20)
+	return nil
+}
+
+// muxCall measures Calc.Sum next to bulk Calc.Blob calls on the same connection.
+func muxCall(addr, codecType string, multiplex bool) {
+	client, err := client.Dial("tcp", addr, &server.Option{CodecType: codecType, Multiplex: multiplex})
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var blob []byte
+				if err := client.Call(context.Background(), "Calc.Blob", &Args{Num1: 8}, &blob); err != nil || len(blob) != 8<<20 {
+					log.Printf("call Calc.Blob error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(time.Second / 10) // let the bulk transfers start
+
+	var latencies []time.Duration
+	for i := 0; i < 50; i++ {
+		var reply int
+		start := time.Now()
+		if err := client.Call(context.Background(), "Calc.Sum", &Args{Num1: i, Num2: i}, &reply); err != nil || reply != 2*i {
+			log.Printf("call Calc.Sum error: %v", err)
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	close(done)
+	wg.Wait()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	log.Printf("%s multiplex %v: Calc.Sum next to 8MB replies, p50 %s, max %s", codecType, multiplex,
+		latencies[len(latencies)/2].Round(time.Microsecond), latencies[len(latencies)-1].Round(time.Microsecond))
+}
+
+func TestMux() {
+	log.SetFlags(0)
+	var c Calc
+	ser := server.NewServer()
+	if err := ser.Register(&c); err != nil {
+		log.Fatal("register error:", err)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go ser.Accept(l)
+
+	for _, codecType := range []string{codec.GobType, codec.BinaryType} {
+		// expect a lower latency with multiplexing
+		muxCall(l.Addr().String(), codecType, false)
+		muxCall(l.Addr().String(), codecType, true)
+	}
+}
+
+// muxWindow is the window of a Seq of the mux codec.
+const muxWindow = 256 << 10
+
+// muxPeer writes parts of messages to a MuxCodec as far as the windows of
+// their Seqs allow, it never ends a message.
+type muxPeer struct {
+	conn    net.Conn
+	mtx     sync.Mutex
+	windows map[uint64]int // bytes granted and not sent yet
+	sent    map[uint64]int
+}
+
+func newMuxPeer(conn net.Conn) *muxPeer {
+	p := &muxPeer{conn: conn, windows: make(map[uint64]int), sent: make(map[uint64]int)}
+	go p.readGrants()
+	return p
+}
+
+// readGrants reads the window chunks, a kind, the uvarint Seq and the uvarint grant.
+func (p *muxPeer) readGrants() {
+	r := bufio.NewReader(p.conn)
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		seq, err := binary.ReadUvarint(r)
+		if err != nil {
+			return
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return
+		}
+		if kind == 2 {
+			p.mtx.Lock()
+			p.windows[seq] += int(n)
+			p.mtx.Unlock()
+		}
+	}
+}
+
+// send writes chunks of 64KB of Seq 1 to n in turns, until total bytes were
+// sent, writing fails or no Seq got a grant for 200ms.
+func (p *muxPeer) send(n, total int) error {
+	for seq := uint64(1); seq <= uint64(n); seq++ {
+		p.windows[seq] = muxWindow
+	}
+	data := make([]byte, 64<<10)
+	chunk := make([]byte, 1+2*binary.MaxVarintLen64+len(data))
+	stalled := time.Now()
+	for sent := 0; sent < total && time.Since(stalled) < time.Second/5; {
+		for seq := uint64(1); seq <= uint64(n); seq++ {
+			p.mtx.Lock()
+			size := len(data)
+			if p.windows[seq] < size {
+				size = p.windows[seq]
+			}
+			p.windows[seq] -= size
+			p.sent[seq] += size
+			p.mtx.Unlock()
+			if size == 0 {
+				continue
+			}
+			k := 1 + binary.PutUvarint(chunk[1:], seq) // the kind of chunk[0] is data
+			k += binary.PutUvarint(chunk[k:], uint64(size))
+			if _, err := p.conn.Write(append(chunk[:k], data[:size]...)); err != nil {
+				return err
+			}
+			sent += size
+			stalled = time.Now()
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+// TestMuxTooLarge sends the parts of a message without end, the codec
+// must fail once the message grows past the limit of 64MB.
+func TestMuxTooLarge() {
+	log.SetFlags(0)
+	conn, peer := net.Pipe()
+	defer func() { _ = peer.Close() }()
+	cc := codec.NewMuxCodecFunc(codec.NewGobCodec, 0)(conn)
+	defer func() { _ = cc.Close() }()
+	go func() { _ = newMuxPeer(peer).send(1, 100<<20) }()
+
+	read := make(chan error, 1)
+	go func() {
+		var h codec.Header
+		read <- cc.ReadHeader(&h)
+	}()
+	select {
+	case err := <-read:
+		log.Printf("100MB of parts of a message: %v", err)
+		expect(err != nil && strings.Contains(err.Error(), "too large"), "read error %v, want too large", err)
+	case <-time.After(5 * time.Second):
+		log.Fatal("FAIL: 100MB of parts of a message accepted")
+	}
+
+	// a peer sending more than it was granted
+	conn, peer = net.Pipe()
+	defer func() { _ = peer.Close() }()
+	cc = codec.NewMuxCodecFunc(codec.NewGobCodec, 0)(conn)
+	defer func() { _ = cc.Close() }()
+	go func() { _, _ = io.Copy(io.Discard, peer) }()
+	go func() {
+		chunk := []byte{0, 1, 0x80, 0x80, 0x20} // Seq 1, 512KB
+		_, _ = peer.Write(append(chunk, make([]byte, 512<<10)...))
+	}()
+	var h codec.Header
+	err := cc.ReadHeader(&h)
+	log.Printf("512KB of a Seq granted 256KB: %v", err)
+	expect(err != nil && strings.Contains(err.Error(), "window"), "read error %v, want the window exceeded", err)
+}
+
+// TestMuxPartial sends parts of messages of 64 Seqs, none of them complete,
+// the codec must stop granting but for one of them once 4MB are buffered.
+func TestMuxPartial() {
+	log.SetFlags(0)
+	conn, peer := net.Pipe()
+	defer func() { _ = peer.Close() }()
+	cc := codec.NewMuxCodecFunc(codec.NewGobCodec, 0)(conn)
+	defer func() { _ = cc.Close() }()
+	p := newMuxPeer(peer)
+	if err := p.send(64, 64<<20); err != nil {
+		log.Fatal("send error:", err)
+	}
+	busiest, others := 0, 0
+	for _, n := range p.sent {
+		if n > busiest {
+			others += busiest
+			busiest = n
+		} else {
+			others += n
+		}
+	}
+	log.Printf("parts of 64 messages: %dKB of the busiest, %dKB of the others", busiest>>10, others>>10)
+	// 4MB buffered, then the rest of the windows of the others
+	expect(others <= 4<<20+64*muxWindow, "%dKB of the others buffered", others>>10)
+}
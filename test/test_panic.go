@@ -0,0 +1,52 @@
+package test
+
+import (
+	"ToyRPC/client"
+	server "ToyRPC/service"
+	"context"
+	"errors"
+	"log"
+	"net"
+)
+
+func (c Calc) Div(args Args, reply *int) error {
+	*reply = args.Num1 / args.Num2 // panics for Num2 == 0
+	return nil
+}
+
+func TestPanic() {
+	log.SetFlags(0)
+	var c Calc
+	ser := server.NewServer(server.WithPanicStack(false))
+	if err := ser.Register(&c); err != nil {
+		log.Fatal("register error:", err)
+	}
+	// an interceptor panicking for Calc.Remaining
+	ser.Use(func(ctx context.Context, info *server.CallInfo, argv, replyv interface{}, next server.Handler) error {
+		if info.Method == "Remaining" {
+			panic("bad interceptor")
+		}
+		return next(ctx, argv, replyv)
+	})
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go ser.Accept(l)
+
+	client, err := client.Dial("tcp", l.Addr().String())
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+	// the server and the connection survive the panics
+	for _, serviceMethod := range []string{"Calc.Div", "Calc.Remaining"} {
+		var reply int
+		err = client.Call(context.Background(), serviceMethod, &Args{Num1: 1, Num2: 0}, &reply)
+		log.Printf("call %s error: %v, is panic: %v", serviceMethod, err, errors.Is(err, server.ErrPanic))
+		expect(errors.Is(err, server.ErrPanic), "call %s: error %v, want a panic", serviceMethod, err)
+		err = client.Call(context.Background(), "Calc.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+		log.Printf("call Calc.Sum after panic: %d, error: %v", reply, err)
+		expect(err == nil && reply == 3, "call Calc.Sum after the panic of %s: reply %d, error %v", serviceMethod, reply, err)
+	}
+}
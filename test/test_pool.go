@@ -0,0 +1,96 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+func logPoolStats(xc *client.XClient, when string) {
+	stats := xc.PoolStats()
+	addrs := make([]string, 0, len(stats))
+	for addr := range stats {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		s := stats[addr]
+		log.Printf("%s %s: conns %d, idle %d, in flight %d, dials %d, closed %d",
+			when, addr, s.Conns, s.Idle, s.InFlight, s.Dials, s.Closed)
+	}
+}
+
+// poolStats returns the stats of the connections to rpcAddr.
+func poolStats(xc *client.XClient, rpcAddr string) client.PoolStats {
+	return xc.PoolStats()[rpcAddr]
+}
+
+func TestPool() {
+	log.SetFlags(0)
+	var servers []string
+	for i := 0; i < 2; i++ {
+		servers = append(servers, startCalcServer())
+	}
+
+	d := client.NewMultiServerDiscovery(servers)
+	xc := client.NewXClient(d, client.RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetPoolOption(client.PoolOption{MinConns: 1, MaxConns: 4, MaxCallsPerConn: 2, IdleTimeout: time.Second / 2})
+
+	done := make(chan int)
+	go func() {
+		failed, _ := runCalls(16, 16, func(i int) error {
+			var reply int
+			return xc.Call(context.Background(), "Calc.Sleep", &Args{Num1: 1, Num2: i}, &reply)
+		})
+		done <- failed
+	}()
+	time.Sleep(time.Second / 2)
+	// 4 connections with 8 calls per server
+	logPoolStats(xc, "busy")
+	for _, s := range servers {
+		stats := poolStats(xc, s)
+		expect(stats.Conns == 4 && stats.InFlight == 8, "busy: %d connections, %d calls in flight, want 4 and 8", stats.Conns, stats.InFlight)
+	}
+	expect(<-done == 0, "calls of Calc.Sleep failed")
+	// 4 idle connections per server
+	logPoolStats(xc, "done")
+	for _, s := range servers {
+		stats := poolStats(xc, s)
+		expect(stats.Conns == 4 && stats.Idle == 4, "done: %d connections, %d idle, want 4 and 4", stats.Conns, stats.Idle)
+	}
+	time.Sleep(time.Second * 3 / 2)
+	// 1 connection per server, MinConns keeps it open
+	logPoolStats(xc, "idle")
+	for _, s := range servers {
+		stats := poolStats(xc, s)
+		expect(stats.Conns == 1 && stats.Closed == 3, "idle: %d connections, %d closed, want 1 and 3", stats.Conns, stats.Closed)
+	}
+}
+
+// TestPoolMinConns checks that MinConns are dialed at the first call, and
+// that closing idle connections follows a new IdleTimeout.
+func TestPoolMinConns() {
+	log.SetFlags(0)
+	rpcAddr := startCalcServer()
+	xc := client.NewXClient(client.NewMultiServerDiscovery([]string{rpcAddr}), client.RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// a single call, 3 connections
+	xc.SetPoolOption(client.PoolOption{MinConns: 3, MaxConns: 4, IdleTimeout: 10 * time.Second})
+	expect(sum(xc, context.Background(), 1) == nil, "call Calc.Sum failed")
+	time.Sleep(time.Second / 10) // let the dials finish
+	logPoolStats(xc, "min conns 3")
+	stats := poolStats(xc, rpcAddr)
+	expect(stats.Conns == 3 && stats.Dials == 3, "%d connections, %d dials, want 3 and 3", stats.Conns, stats.Dials)
+
+	// the connections idle for 200ms are closed, not only after 10s
+	xc.SetPoolOption(client.PoolOption{IdleTimeout: time.Second / 5})
+	expect(sum(xc, context.Background(), 1) == nil, "call Calc.Sum failed")
+	time.Sleep(time.Second * 6 / 10)
+	logPoolStats(xc, "idle timeout 200ms")
+	stats = poolStats(xc, rpcAddr)
+	expect(stats.Conns == 0, "%d connections left idle for 600ms, want 0", stats.Conns)
+}
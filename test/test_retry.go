@@ -0,0 +1,154 @@
+package test
+
+import (
+	"ToyRPC/client"
+	server "ToyRPC/service"
+	"context"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// startResetServer accepts connections and closes them once a request arrives.
+func startResetServer() string {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1024)
+				_, _ = conn.Read(buf)
+				time.Sleep(time.Second / 20)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return "tcp@" + l.Addr().String()
+}
+
+// deadAddr returns an address nothing listens on.
+func deadAddr() string {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	addr := "tcp@" + l.Addr().String()
+	_ = l.Close()
+	return addr
+}
+
+// retryCalls makes n calls of Calc.Sum with policy one by one,
+// it returns how many failed and the attempts made on every server.
+func retryCalls(servers []string, policy client.RetryPolicy, nonIdempotent bool, n int) (int, *callCounter) {
+	d := client.NewMultiServerDiscovery(servers)
+	xc := client.NewXClient(d, client.RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetRetryPolicy(policy)
+	if nonIdempotent {
+		xc.MarkNonIdempotent("Calc.Sum")
+	}
+	cc := countCalls(xc)
+	failed, _ := runCalls(1, n, func(i int) error { return sum(xc, context.Background(), i) })
+	log.Printf("non-idempotent %v, %d attempts at most: %d of %d calls failed, attempts per server %v",
+		nonIdempotent, policy.MaxAttempts, failed, n, cc.perServer(servers))
+	return failed, cc
+}
+
+func TestRetry() {
+	log.SetFlags(0)
+	alive := startCalcServer()
+	policy := client.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond, Jitter: 0.2}
+
+	// round robin picks the dead server first for every call but maybe the first one,
+	// the calls succeed on the second attempt
+	dead := deadAddr()
+	failed, cc := retryCalls([]string{dead, alive}, policy, false, 10)
+	expect(failed == 0 && cc.count(alive) == 10 && cc.count(dead) >= 9, "dial failures not retried")
+	// the requests reset by a server are sent again
+	reset := startResetServer()
+	failed, cc = retryCalls([]string{reset, alive}, policy, false, 10)
+	expect(failed == 0 && cc.count(alive) == 10 && cc.count(reset) >= 9, "reset requests not retried")
+	// the reset requests of a non-idempotent method may have been handled,
+	// they fail, so round robin takes turns and half of the calls fail
+	failed, cc = retryCalls([]string{reset, alive}, policy, true, 10)
+	expect(failed == 5 && failed == cc.count(reset) && cc.count(alive) == 10-failed,
+		"reset non-idempotent requests: %d failed, want the %d sent to the reset server", failed, cc.count(reset))
+	// dial failures are retried nonetheless, the request wasn't sent
+	failed, cc = retryCalls([]string{dead, alive}, policy, true, 10)
+	expect(failed == 0 && cc.count(alive) == 10, "dial failures of a non-idempotent method not retried")
+
+	// the retries stop once the budget is used up: every failure takes
+	// 1 of 10 tokens, retries stop at 5 left, so 3 + 2 attempts then 1 per call
+	policy.BudgetTokens, policy.BudgetRatio = 10, 0.1
+	failed, cc = retryCalls([]string{deadAddr(), deadAddr()}, policy, false, 10)
+	expect(failed == 10 && cc.total() == 13, "budget: %d attempts, want 13", cc.total())
+
+	// a single attempt, the backoff doesn't fit into the deadline
+	d := client.NewMultiServerDiscovery([]string{deadAddr()})
+	xc := client.NewXClient(d, client.RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetRetryPolicy(client.RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second})
+	cc = countCalls(xc)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/2)
+	defer cancel()
+	start := time.Now()
+	err := sum(xc, ctx, 1)
+	log.Printf("call with deadline error after %s: %v", time.Since(start).Round(time.Millisecond), err)
+	expect(err != nil && cc.total() == 1 && time.Since(start) < time.Second/2,
+		"deadline: %d attempts in %s, want 1 right away", cc.total(), time.Since(start))
+}
+
+// TestRetryRefused checks that a non-idempotent call never written is retried:
+// the server of the first attempt shuts down after it was picked, so the client
+// got the goaway before writing.
+func TestRetryRefused() {
+	log.SetFlags(0)
+	servers := make(map[string]*server.Server)
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		var c Calc
+		ser := server.NewServer()
+		if err := ser.Register(&c); err != nil {
+			log.Fatal("register error:", err)
+		}
+		l, err := net.Listen("tcp", ":0")
+		if err != nil {
+			log.Fatal("network error:", err)
+		}
+		go ser.Accept(l)
+		addr := "tcp@" + l.Addr().String()
+		servers[addr] = ser
+		addrs = append(addrs, addr)
+	}
+	var shutdown int32
+	xc := client.NewXClient(client.NewMultiServerDiscovery(addrs), client.RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetRetryPolicy(client.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+	xc.MarkNonIdempotent("Calc.Sum")
+	var served []string
+	xc.UseEndpoint(func(ctx context.Context, rpcAddr, serviceMethod string, args, reply interface{}, invoker client.Invoker) error {
+		served = append(served, rpcAddr)
+		return invoker(ctx, serviceMethod, args, reply)
+	}, func(ctx context.Context, rpcAddr, serviceMethod string, args, reply interface{}, invoker client.Invoker) error {
+		if atomic.CompareAndSwapInt32(&shutdown, 0, 1) {
+			go func() { _ = servers[rpcAddr].Shutdown(context.Background()) }()
+			time.Sleep(time.Second / 10) // let the goaway arrive
+		}
+		return invoker(ctx, serviceMethod, args, reply)
+	})
+	var reply int
+	if err := xc.Call(context.Background(), "Calc.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+		log.Fatalf("call refused by the client: reply %d, error %v, want it retried on the other server", reply, err)
+	}
+	if len(served) != 2 || served[0] == served[1] {
+		log.Fatalf("call refused by the client: attempts on %v, want both servers", served)
+	}
+	log.Println("call refused by the client: retried on the other server")
+}
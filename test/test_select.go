@@ -0,0 +1,77 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"context"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// startStallServer accepts connections and never replies.
+func startStallServer() string {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(io.Discard, conn) }()
+		}
+	}()
+	return "tcp@" + l.Addr().String()
+}
+
+var selectModeNames = map[int]string{
+	client.RandomSelect:             "random",
+	client.RoundRobinSelect:         "round robin",
+	client.WeightedRoundRobinSelect: "weighted round robin",
+	client.LeastPendingSelect:       "least pending",
+	client.PowerOfTwoChoicesSelect:  "power of two choices",
+}
+
+// selectCalls makes 100 calls of Calc.Sum from 10 goroutines, each timing out after 200ms,
+// it returns how many timed out and how many went to each server.
+func selectCalls(xc *client.XClient, servers []string, mode int) (int, []int) {
+	xc.SetFailMode(client.Failfast, 0)
+	cc := countCalls(xc)
+	failed, _ := runCalls(10, 100, func(i int) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second/5)
+		defer cancel()
+		return sum(xc, ctx, i)
+	})
+	calls := cc.perServer(servers)
+	log.Printf("%s: calls per server %v, %d timed out", selectModeNames[mode], calls, failed)
+	return failed, calls
+}
+
+func TestSelectMode() {
+	log.SetFlags(0)
+	weighted := []string{startCalcServer() + "?weight=3", startCalcServer() + "?weight=1", startCalcServer() + "?weight=0"}
+	xc := client.NewXClient(client.NewMultiServerDiscovery(weighted), client.WeightedRoundRobinSelect, nil)
+	failed, calls := selectCalls(xc, weighted, client.WeightedRoundRobinSelect)
+	_ = xc.Close()
+	expect(failed == 0 && calls[0] == 75 && calls[1] == 25 && calls[2] == 0, "calls %v, want 3 : 1 : 0", calls)
+
+	stalled := []string{startCalcServer(), startCalcServer(), startStallServer()}
+	xc = client.NewXClient(client.NewMultiServerDiscovery(stalled), client.RoundRobinSelect, nil)
+	failed, calls = selectCalls(xc, stalled, client.RoundRobinSelect)
+	_ = xc.Close()
+	expect(failed == calls[2] && failed >= 30, "%d calls timed out, want a third", failed)
+	// the stalled server has calls pending, so it gets few calls; both XClients
+	// share the discovery but go by their own calls
+	d := client.NewMultiServerDiscovery(stalled)
+	leastPending := client.NewXClient(d, client.LeastPendingSelect, nil)
+	defer func() { _ = leastPending.Close() }()
+	twoChoices := client.NewXClient(d, client.PowerOfTwoChoicesSelect, nil)
+	defer func() { _ = twoChoices.Close() }()
+	failed, _ = selectCalls(leastPending, stalled, client.LeastPendingSelect)
+	expect(failed <= 10, "least pending: %d calls timed out", failed)
+	failed, _ = selectCalls(twoChoices, stalled, client.PowerOfTwoChoicesSelect)
+	expect(failed <= 10, "power of two choices: %d calls timed out", failed)
+}
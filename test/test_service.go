@@ -43,7 +43,8 @@ func TestService() {
 	time.Sleep(time.Second)
 	// send request & receive response
 	var wg sync.WaitGroup
-	ctx, _ := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
 	for i := 0; i < rpc_cnt; i++ {
 		wg.Add(1)
 		go func(i int) {
@@ -0,0 +1,111 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"ToyRPC/codec"
+	server "ToyRPC/service"
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+func TestShutdown() {
+	log.SetFlags(0)
+	var c Calc
+	ser := server.NewServer()
+	if err := ser.Register(&c); err != nil {
+		log.Fatal("register error:", err)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go ser.Accept(l)
+
+	client, _ := client.Dial("tcp", l.Addr().String())
+	defer client.Close()
+	var wg sync.WaitGroup
+	for i := 1; i <= 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var reply int
+			// expect all of them to be answered before the server is gone
+			err := client.Call(context.Background(), "Calc.Sleep", &Args{Num1: i, Num2: i * i}, &reply)
+			if err != nil {
+				log.Printf("call Calc.Sleep error: %v", err)
+			} else {
+				log.Printf("call Calc.Sleep success: %d + %d = %d", i, i*i, reply)
+			}
+		}(i)
+	}
+	time.Sleep(time.Second / 10)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := ser.Shutdown(ctx); err != nil {
+		log.Println("shutdown error:", err)
+	}
+	wg.Wait()
+	log.Println("client available after shutdown:", client.IsAvailable())
+}
+
+// TestShutdownLateRequest sends a request after Shutdown has started on a
+// connection that doesn't act on the goaway message, as a request that
+// crossed the message on the wire. It must be answered, not cut off.
+func TestShutdownLateRequest() {
+	log.SetFlags(0)
+	var c Calc
+	ser := server.NewServer()
+	if err := ser.Register(&c); err != nil {
+		log.Fatal("register error:", err)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go ser.Accept(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(server.DefaultOption); err != nil {
+		log.Fatal("options error:", err)
+	}
+	cc := codec.NewGobCodec(conn)
+	time.Sleep(time.Second / 10) // let the server track the connection
+
+	done := make(chan error, 1)
+	go func() { done <- ser.Shutdown(context.Background()) }()
+	time.Sleep(time.Second / 10)
+	h := &codec.Header{ServiceMethod: "Calc.Sum", Seq: 1}
+	if err := cc.Write(h, &Args{Num1: 1, Num2: 2}); err != nil {
+		log.Fatal("write error:", err)
+	}
+	var reply int
+	for {
+		var rh codec.Header
+		if err := cc.ReadHeader(&rh); err != nil {
+			log.Fatal("the late request was not answered:", err)
+		}
+		if rh.Kind == codec.KindGoAway {
+			_ = cc.ReadBody(nil)
+			continue
+		}
+		if err := cc.ReadBody(&reply); err != nil || rh.Error != "" {
+			log.Fatalf("late request error: %v %s", err, rh.Error)
+		}
+		break
+	}
+	if reply != 3 {
+		log.Fatalf("late request reply = %d, want 3", reply)
+	}
+	log.Println("late request answered during shutdown:", reply)
+	if err := <-done; err != nil {
+		log.Fatal("shutdown error:", err)
+	}
+}
@@ -0,0 +1,65 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"ToyRPC/codec"
+	server "ToyRPC/service"
+	"ToyRPC/status"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+func (c Calc) Checked(args Args, reply *int) error {
+	if args.Num2 == 0 {
+		return status.New(status.InvalidArgument, "Num2 must not be zero").WithDetails("field", "Num2")
+	}
+	*reply = args.Num1 / args.Num2
+	return nil
+}
+
+func TestStatus() {
+	log.SetFlags(0)
+	var c Calc
+	ser := server.NewServer()
+	if err := ser.Register(&c); err != nil {
+		log.Fatal("register error:", err)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go ser.Accept(l)
+
+	for _, codecType := range []string{codec.GobType, codec.JsonType, codec.BinaryType} {
+		client, err := client.Dial("tcp", l.Addr().String(), &server.Option{CodecType: codecType})
+		if err != nil {
+			log.Fatal("dial error:", err)
+		}
+		var reply int
+		calls := []struct {
+			serviceMethod string
+			args          *Args
+		}{
+			{"Calc.Missing", &Args{}},          // expect NotFound
+			{"Calc.Checked", &Args{1, 0}},      // expect InvalidArgument with details
+			{"Calc.Div", &Args{1, 0}},          // expect Internal
+			{"Calc.SleepContext", &Args{1, 0}}, // expect DeadlineExceeded
+			{"Calc.Checked", &Args{4, 2}},      // expect OK
+		}
+		for _, call := range calls {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second/2)
+			err := client.Call(ctx, call.serviceMethod, call.args, &reply)
+			cancel()
+			var st *status.Error
+			if errors.As(err, &st) {
+				log.Printf("%s call %s: code %s, details %v, error: %v", codecType, call.serviceMethod, st.Code, st.Details, err)
+			} else {
+				log.Printf("%s call %s: code %s, reply %d", codecType, call.serviceMethod, status.CodeOf(err), reply)
+			}
+		}
+		_ = client.Close()
+	}
+}
@@ -0,0 +1,98 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"ToyRPC/codec"
+	"ToyRPC/metadata"
+	server "ToyRPC/service"
+	"context"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var watchStopped int64 // number of Watch calls that saw their stream cancelled
+
+// Count sends every number from Num1 to Num2.
+func (c Calc) Count(args Args, stream *server.ServerStream) error {
+	for i := args.Num1; i <= args.Num2; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+	}
+	metadata.SetTrailer(stream.Context(), metadata.Pairs("count", "done"))
+	return nil
+}
+
+// Watch sends the sum of Num1 and Num2 until the stream is cancelled.
+func (c Calc) Watch(ctx context.Context, args Args, stream *server.ServerStream) error {
+	for {
+		if err := stream.Send(args.Num1 + args.Num2); err != nil {
+			atomic.AddInt64(&watchStopped, 1)
+			return err
+		}
+		select {
+		case <-time.After(time.Second / 100):
+		case <-ctx.Done():
+			atomic.AddInt64(&watchStopped, 1)
+			return ctx.Err()
+		}
+	}
+}
+
+func streamCall(addr, codecType string) {
+	client, err := client.Dial("tcp", addr, &server.Option{CodecType: codecType})
+	if err != nil {
+		log.Fatal("dial error:", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	stream, err := client.Stream(context.Background(), "Calc.Count", &Args{Num1: 1, Num2: 5}, &reply)
+	if err != nil {
+		log.Fatal("stream error:", err)
+	}
+	sum := 0
+	for stream.Next() {
+		sum += reply
+	}
+	log.Printf("%s stream Calc.Count: sum %d, error: %v, trailer: %v", codecType, sum, stream.Err(), stream.Trailer())
+
+	// expect the server to stop watching once we are gone
+	stream, err = client.Stream(context.Background(), "Calc.Watch", &Args{Num1: 1, Num2: 2}, &reply)
+	if err != nil {
+		log.Fatal("stream error:", err)
+	}
+	n := 0
+	for n < 3 && stream.Next() {
+		n++
+	}
+	_ = stream.Close()
+	log.Printf("%s stream Calc.Watch: %d replies of %d, error: %v", codecType, n, reply, stream.Err())
+
+	// a plain call can't read a stream
+	err = client.Call(context.Background(), "Calc.Count", &Args{Num1: 1, Num2: 5}, &reply)
+	log.Printf("%s call Calc.Count error: %v", codecType, err)
+}
+
+func TestStream() {
+	log.SetFlags(0)
+	var c Calc
+	ser := server.NewServer()
+	if err := ser.Register(&c); err != nil {
+		log.Fatal("register error:", err)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("network error:", err)
+	}
+	go ser.Accept(l)
+
+	for _, codecType := range []string{codec.GobType, codec.JsonType, codec.BinaryType} {
+		atomic.StoreInt64(&watchStopped, 0)
+		streamCall(l.Addr().String(), codecType)
+		time.Sleep(time.Second / 10) // let the cancel message arrive
+		log.Printf("%s: %d watches stopped, expect 1", codecType, atomic.LoadInt64(&watchStopped))
+	}
+}
@@ -84,7 +84,8 @@ func broadcast(addr1, addr2 string) {
 			defer wg.Done()
 			xMethod(xc, context.Background(), "broadcast", "Calc.Sum", &Args{Num1: i, Num2: i * i})
 			// expect 2 - 5 timeout
-			ctx, _ := context.WithTimeout(context.Background(), time.Second*2)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+			defer cancel()
 			xMethod(xc, ctx, "broadcast", "Calc.Sleep", &Args{Num1: i, Num2: i * i})
 		}(i)
 	}
@@ -0,0 +1,138 @@
+package test
+
+import (
+	"ToyRPC/client"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// callCounter counts the calls XClient makes to every server,
+// and the servers the calls of every routing key went to.
+type callCounter struct {
+	mtx    sync.Mutex
+	counts map[string]int
+	keys   map[string]map[string]bool
+}
+
+// countCalls installs a callCounter as an endpoint interceptor of xc.
+func countCalls(xc *client.XClient) *callCounter {
+	cc := &callCounter{}
+	cc.reset()
+	xc.UseEndpoint(cc.intercept)
+	return cc
+}
+
+func (cc *callCounter) intercept(ctx context.Context, rpcAddr, serviceMethod string, args, reply interface{}, invoker client.Invoker) error {
+	cc.mtx.Lock()
+	cc.counts[rpcAddr]++
+	if key, ok := client.RoutingKeyFromContext(ctx); ok {
+		if cc.keys[key] == nil {
+			cc.keys[key] = make(map[string]bool)
+		}
+		cc.keys[key][rpcAddr] = true
+	}
+	cc.mtx.Unlock()
+	return invoker(ctx, serviceMethod, args, reply)
+}
+
+// reset forgets the calls counted so far.
+func (cc *callCounter) reset() {
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+	cc.counts = make(map[string]int)
+	cc.keys = make(map[string]map[string]bool)
+}
+
+func (cc *callCounter) count(rpcAddr string) int {
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+	return cc.counts[rpcAddr]
+}
+
+func (cc *callCounter) total() int {
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+	n := 0
+	for _, c := range cc.counts {
+		n += c
+	}
+	return n
+}
+
+// perServer returns the calls to every one of servers.
+func (cc *callCounter) perServer(servers []string) []int {
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+	calls := make([]int, len(servers))
+	for i, s := range servers {
+		calls[i] = cc.counts[s]
+	}
+	return calls
+}
+
+// keyServers returns the servers the calls of every routing key went to.
+func (cc *callCounter) keyServers() map[string]map[string]bool {
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+	keys := make(map[string]map[string]bool, len(cc.keys))
+	for key, servers := range cc.keys {
+		keys[key] = make(map[string]bool, len(servers))
+		for s := range servers {
+			keys[key][s] = true
+		}
+	}
+	return keys
+}
+
+// runCalls runs call for i in [0, n) from workers goroutines,
+// it returns how many calls failed and how long they took.
+func runCalls(workers, n int, call func(i int) error) (failed int, elapsed time.Duration) {
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	next := 0
+	start := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mtx.Lock()
+				i := next
+				next++
+				mtx.Unlock()
+				if i >= n {
+					return
+				}
+				if err := call(i); err != nil {
+					mtx.Lock()
+					failed++
+					mtx.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return failed, time.Since(start)
+}
+
+// sum calls Calc.Sum of i and i, which must reply 2*i.
+func sum(xc *client.XClient, ctx context.Context, i int) error {
+	var reply int
+	if err := xc.Call(ctx, "Calc.Sum", &Args{Num1: i, Num2: i}, &reply); err != nil {
+		return err
+	}
+	if reply != 2*i {
+		return fmt.Errorf("call Calc.Sum: reply %d, want %d", reply, 2*i)
+	}
+	return nil
+}
+
+// expect stops the test with the formatted message unless ok.
+func expect(ok bool, format string, a ...interface{}) {
+	if !ok {
+		log.Fatalf("FAIL: "+format, a...)
+	}
+}